@@ -9,6 +9,7 @@ package merle
 
 import (
 	"fmt"
+	"net/http"
 	"regexp"
 )
 
@@ -65,6 +66,7 @@ func newBridge(thing *Thing, portBegin, portEnd uint) *bridge {
 
 	b.ports = newPorts(thing, portBegin, portEnd, b.bridgeAttach)
 	b.thing.web.handleBridgePortId()
+	b.thing.web.handleBridgeAttach()
 
 	return b
 }
@@ -115,6 +117,11 @@ func (b *bridge) newChild(id, model, name string) (*Thing, error) {
 	child.Cfg.Name = name
 	child.Cfg.IsPrime = true
 
+	// Child dispatches Packets the same as the bridge
+	child.Cfg.AsyncDispatch = b.thing.Cfg.AsyncDispatch
+	child.Cfg.QueueDepth = b.thing.Cfg.QueueDepth
+	child.Cfg.QueuePolicy = b.thing.Cfg.QueuePolicy
+
 	err := child.build(false)
 	if err != nil {
 		return nil, err
@@ -126,7 +133,7 @@ func (b *bridge) newChild(id, model, name string) (*Thing, error) {
 }
 
 func (b *bridge) sendStatus(child *Thing) {
-	msg := MsgEventStatus{Msg: EventStatus, Id: child.id, Online: child.online}
+	msg := MsgEventStatus{Msg: EventStatus, Id: child.id, Online: child.isOnline()}
 	b.thing.bus.receive(newPacket(b.thing.bus, nil, &msg))
 	newPacket(child.bus, child.primeSock, &msg).Broadcast()
 }
@@ -139,12 +146,12 @@ func (b *bridge) bridgeReady(child *Thing) {
 	b.bus.plugin(child.childSock)
 	child.bus.plugin(child.bridgeSock)
 
-	child.online = true
+	child.setOnline(true)
 	b.sendStatus(child)
 }
 
 func (b *bridge) bridgeCleanup(child *Thing) {
-	child.online = false
+	child.setOnline(false)
 	b.sendStatus(child)
 
 	child.bus.unplug(child.bridgeSock)
@@ -163,6 +170,9 @@ func (b *bridge) bridgeAttach(p *port, msg *MsgIdentity) error {
 		}
 		b.children[msg.Id] = child
 	} else {
+		if child.isOnline() {
+			return fmt.Errorf("Bridge attach child already attached")
+		}
 		if child.model != msg.Model {
 			return fmt.Errorf("Bridge attach model mismatch")
 		}
@@ -177,6 +187,21 @@ func (b *bridge) bridgeAttach(p *port, msg *MsgIdentity) error {
 	return child.runOnPort(p, b.bridgeReady, b.bridgeCleanup)
 }
 
+// Attach a child which dialed in to the bridge on its link (see link)
+func (b *bridge) linkAttach(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		b.thing.log.println("Link upgrader error:", err)
+		return
+	}
+
+	p := newPort(b.thing, 0, b.bridgeAttach)
+	p.name = "link:" + r.RemoteAddr
+	p.ws = ws
+
+	p.attachLink()
+}
+
 func (b *bridge) start() {
 	if err := b.ports.start(); err != nil {
 		b.thing.log.println("Starting bridge error:", err)
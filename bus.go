@@ -4,7 +4,12 @@
 
 package merle
 
-import "sync"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
 
 // Subscribers is a map of message subscribers, keyed by Msg type.  On Packet
 // receipt, the Packet Msg is used to lookup a subscriber.  If a match, the
@@ -40,9 +45,33 @@ import "sync"
 // 		"default": nil,             // drop everything else silently
 // 	}
 // }
+//
+// A key may also be a pattern matching a family of messages.  In a pattern,
+// "*" matches any sequence of characters (including none) and "+" matches
+// one or more characters up to the next "." or "/" separator.  For example,
+// "Sensor.*" matches "Sensor.Temp" and "Sensor.Temp.Max", while "Relay/+"
+// matches "Relay/1" but not "Relay/1/State".
+//
+// func (b *bridge) BridgeSubscribers() merle.Subscribers {
+// 	return merle.Subscribers{
+// 		"Sensor.*": merle.Broadcast, // broadcast all sensor msgs
+// 		"Relay/+":  b.relay,         // handle msgs for each relay
+// 		"Relay/0":  nil,             // except relay 0
+// 		"default":  nil,             // drop everything else silently
+// 	}
+// }
+//
+// On Packet receipt, an exact match is tried first.  If there is no exact
+// match, the most-specific matching pattern is used.  The most-specific
+// pattern is the pattern with the most literal (non-wildcard) characters.  If
+// there is still a tie, a pattern with fewer "*" wildcards wins, and then the
+// pattern which sorts first.  If no pattern matches, the "default" subscriber
+// is used.
 type Subscribers map[string]func(*Packet)
 
-type sockets map[socketer]bool
+// sockets plugged into the bus, and the socket's queues, if dispatching
+// asynchronously
+type sockets map[socketer]*sockQueue
 type socketQ chan bool
 
 type bus struct {
@@ -51,17 +80,40 @@ type bus struct {
 	sockLock sync.RWMutex
 	sockets  sockets
 	socketQ  socketQ
+	async    bool
 	// message subscribers
 	subs Subscribers
+	// subscriber patterns, in order of precedence
+	patterns []string
+	// middleware chain
+	mws []Middleware
+	// outstanding requests, keyed by request Id
+	reqLock  sync.Mutex
+	requests map[string]chan *Packet
+	reqNonce string
+	reqNext  uint64
+	// retained messages, keyed by message type, in order retained
+	retainLock sync.Mutex
+	retained   map[string]*Packet
+	retainKeys []string
+	// sockets being caught up on retained messages, with the broadcasts
+	// held for them meanwhile (see enableBroadcast)
+	replaying map[socketer][]*Packet
 }
 
 func newBus(thing *Thing, socketsMax uint, subs Subscribers) *bus {
-	return &bus{
-		thing:   thing,
-		sockets: make(sockets),
-		socketQ: make(socketQ, socketsMax),
-		subs:    subs,
+	b := &bus{
+		thing:    thing,
+		sockets:  make(sockets),
+		socketQ:  make(socketQ, socketsMax),
+		async:    thing.Cfg.AsyncDispatch,
+		subs:     subs,
+		requests: make(map[string]chan *Packet),
+		reqNonce: newRequestNonce(),
+		retained: make(map[string]*Packet),
 	}
+	b.sortPatterns()
+	return b
 }
 
 // Plug a socket into the bus
@@ -69,14 +121,22 @@ func (b *bus) plugin(s socketer) {
 	// Queue any plugin attempts beyond socketsMax
 	b.socketQ <- true
 
+	var q *sockQueue
+	if b.async {
+		q = newSockQueue(b, s)
+	}
+
 	b.sockLock.Lock()
-	b.sockets[s] = true
+	b.sockets[s] = q
 	b.sockLock.Unlock()
 }
 
 // Unplug a socket from the bus
 func (b *bus) unplug(s socketer) {
 	b.sockLock.Lock()
+	if q := b.sockets[s]; q != nil {
+		q.stop()
+	}
 	delete(b.sockets, s)
 	b.sockLock.Unlock()
 
@@ -86,22 +146,146 @@ func (b *bus) unplug(s socketer) {
 // Subscribe to message
 func (b *bus) subscribe(msg string, f func(*Packet)) {
 	b.subs[msg] = f
+	b.sortPatterns()
+}
+
+func isPattern(key string) bool {
+	return strings.ContainsAny(key, "*+")
+}
+
+// Literal (non-wildcard) characters in pattern
+func patternLiterals(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*") -
+		strings.Count(pattern, "+")
+}
+
+// Sort subscriber patterns from most-specific to least-specific
+func (b *bus) sortPatterns() {
+	b.patterns = b.patterns[:0]
+	for key := range b.subs {
+		if isPattern(key) {
+			b.patterns = append(b.patterns, key)
+		}
+	}
+	sort.Slice(b.patterns, func(i, j int) bool {
+		pi, pj := b.patterns[i], b.patterns[j]
+		li, lj := patternLiterals(pi), patternLiterals(pj)
+		if li != lj {
+			return li > lj
+		}
+		si, sj := strings.Count(pi, "*"), strings.Count(pj, "*")
+		if si != sj {
+			return si < sj
+		}
+		return pi < pj
+	})
+}
+
+func isSeparator(c byte) bool {
+	return c == '.' || c == '/'
+}
+
+// Match msg against pattern.  "*" matches any sequence of characters
+// (including none), "+" matches one or more characters up to the next
+// separator.
+func matchPattern(pattern, msg string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(msg); i++ {
+				if matchPattern(pattern[1:], msg[i:]) {
+					return true
+				}
+			}
+			return false
+		case '+':
+			for i := 1; i <= len(msg) && !isSeparator(msg[i-1]); i++ {
+				if matchPattern(pattern[1:], msg[i:]) {
+					return true
+				}
+			}
+			return false
+		default:
+			if len(msg) == 0 || msg[0] != pattern[0] {
+				return false
+			}
+			pattern, msg = pattern[1:], msg[1:]
+		}
+	}
+	return len(msg) == 0
+}
+
+// Lookup subscriber for msg.  Exact match first, then most-specific
+// pattern match.
+func (b *bus) lookupSub(msg string) (key string, f func(*Packet), match bool) {
+	if f, match = b.subs[msg]; match {
+		return msg, f, true
+	}
+	for _, pattern := range b.patterns {
+		if matchPattern(pattern, msg) {
+			return pattern, b.subs[pattern], true
+		}
+	}
+	return "", nil, false
 }
 
 // Receive matches the packet against subscribers and calls the matching
 // subscriber handler.  If no subscribers match the received message, the
 // "default" subscriber matches.  If still no matches, the packet is (silently)
 // dropped.
+//
+// A packet which is a reply to an outstanding request is handed to the
+// requester rather than to the subscribers.
+//
+// Cmd messages (CmdInit, CmdRun, CmdStop) only originate from the system, so
+// a Cmd message received on a socket plugged into the bus is dropped.
 func (b *bus) receive(p *Packet) {
+	if b.plugged(p.src) && isCmd(p) {
+		b.thing.log.printf("Dropped [%s]: %.80s", p.src.Name(), p.String())
+		return
+	}
+	if b.queueIn(p) {
+		// Packet will be dispatched from socket's inbound queue
+		return
+	}
+	b.intercept(p, DirReceive, b.doReceive)
+}
+
+func isCmd(p *Packet) bool {
+	var msg Msg
+
+	p.Unmarshal(&msg)
+	return strings.HasPrefix(msg.Msg, "_Cmd")
+}
+
+func (b *bus) doReceive(p *Packet) {
 	var msg Msg
 
 	p.Unmarshal(&msg)
 
-	f, match := b.subs[msg.Msg]
+	if !b.replied(p) {
+		b.dispatch(p, msg.Msg)
+	}
+
+	// Receiving ReplyState is a special case.  The socket is disabled for
+	// broadcasts until ReplyState is received.
+
+	if msg.Msg == ReplyState {
+		b.enableBroadcast(p.src)
+	}
+}
+
+func (b *bus) dispatch(p *Packet, msg string) {
+	key, f, match := b.lookupSub(msg)
 	if match {
 		if f != nil {
-			b.thing.log.printf("Received [%s]: %.80s", p.Src(),
-				p.String())
+			if key == msg {
+				b.thing.log.printf("Received [%s]: %.80s", p.Src(),
+					p.String())
+			} else {
+				b.thing.log.printf("Received [%s] by %s: %.80s",
+					p.Src(), key, p.String())
+			}
 			f(p)
 		}
 	} else {
@@ -117,17 +301,14 @@ func (b *bus) receive(p *Packet) {
 				p.String())
 		}
 	}
-
-	// Receiving ReplyState is a special case.  The socket is disabled for
-	// broadcasts until ReplyState is received.
-
-	if msg.Msg == ReplyState {
-		p.src.SetFlags(p.src.Flags() | sock_flag_bcast)
-	}
 }
 
 // Reply sends the packet back to the source socket
 func (b *bus) reply(p *Packet) {
+	b.intercept(p, DirReply, b.doReply)
+}
+
+func (b *bus) doReply(p *Packet) {
 	if p.src == nil {
 		b.thing.log.println("Reply aborted; source is missing")
 		return
@@ -136,31 +317,42 @@ func (b *bus) reply(p *Packet) {
 	msg := Msg{}
 	p.Unmarshal(&msg)
 
+	// If replying to a request, tag the reply so the requester can
+	// match it up
+	b.tagReply(p)
+
 	b.thing.log.printf("Reply: %.80s", p.String())
-	p.src.Send(p)
+	b.sockSend(p.src, b.sockQueue(p.src), p)
 
 	// Sending ReplyState is a special case.  The socket is disabled for
 	// broadcasts until ReplyState is sent.  This ensures other end doesn't
 	// receive unsolicited broadcast messages before ReplyState.
 
 	if msg.Msg == ReplyState {
-		p.src.SetFlags(p.src.Flags() | sock_flag_bcast)
+		b.enableBroadcast(p.src)
 	}
 }
 
 // Broadcast sends the packet to each socket on the bus, expect to the
 // originating socket
 func (b *bus) broadcast(p *Packet) {
-	sent := 0
-	src := p.src
+	b.intercept(p, DirBroadcast, b.doBroadcast)
+}
+
+// A socket to send a broadcast to, and the socket's queues
+type bcastSock struct {
+	sock socketer
+	q    *sockQueue
+}
+
+// Sockets ready for broadcasts, except src
+func (b *bus) bcastSockets(src socketer) []bcastSock {
+	var socks []bcastSock
 
 	b.sockLock.RLock()
 	defer b.sockLock.RUnlock()
 
-	// TODO Perf optimization: use websocket.NewPreparedMessage
-	// TODO to prepare msg once, and then send on each connection
-
-	for sock := range b.sockets {
+	for sock, q := range b.sockets {
 		if sock == src {
 			// don't send back to src
 			//b.thing.log.println("Skipping broadcast to self:", sock.Name())
@@ -173,43 +365,107 @@ func (b *bus) broadcast(p *Packet) {
 			b.thing.log.println("Skipping broadcast; not ready:", sock.Name())
 			continue
 		}
-		if sent == 0 {
-			b.thing.log.printf("Broadcast: %.80s", p.String())
-			sent++
-		}
-		sock.Send(p)
+		socks = append(socks, bcastSock{sock, q})
 	}
 
-	if sent == 0 {
+	return socks
+}
+
+func (b *bus) doBroadcast(p *Packet) {
+	src := p.src
+
+	// Snapshot the packet to share across all sockets.  (The snapshot is
+	// safe from the handler re-Marshaling p while sockets are still
+	// sending).
+	retain := p.retain
+	p = p.clone(p.bus, p.src)
+
+	// Retained and held broadcasts get their own snapshot, which is never
+	// changed, as p is when prepared below.
+	shared := p.clone(p.bus, p.src)
+
+	// Retain, and pick the sockets, under retainLock, so the broadcast
+	// and a new socket's replay of retained messages are ordered (see
+	// enableBroadcast).
+	b.retainLock.Lock()
+	if retain {
+		b.retain(shared)
+	}
+	socks := b.holdBroadcast(shared, b.bcastSockets(src))
+	b.retainLock.Unlock()
+
+	// Send without holding sockLock, so a socket blocked sending (say,
+	// with a full outbound queue) doesn't hold up sockets plugging into
+	// or unplugging from the bus.  Unplugging a socket stops its queues,
+	// which unblocks the send.
+
+	if len(socks) == 0 {
 		b.thing.log.printf("Would Broadcast: %.80s", p.String())
+		return
+	}
+
+	b.thing.log.printf("Broadcast: %.80s", p.String())
+
+	for _, s := range socks {
+		// Prepare the msg once, on the first websocket, to share
+		// with the rest
+		preparePacket(p, s.sock)
+		b.sockSend(s.sock, s.q, p)
 	}
 }
 
-func (b *bus) send(p *Packet, dst string) {
-	sent := false
+// Socket is plugged into the bus
+func (b *bus) plugged(sock socketer) bool {
+	b.sockLock.RLock()
+	defer b.sockLock.RUnlock()
+
+	_, ok := b.sockets[sock]
+	return ok
+}
 
+// Lookup socket on bus by source Id
+func (b *bus) lookup(dst string) socketer {
 	b.sockLock.RLock()
 	defer b.sockLock.RUnlock()
 
 	for sock := range b.sockets {
 		if sock.Src() == dst {
-			b.thing.log.printf("Send to [%s]: %.80s", dst, p.String())
-			sock.Send(p)
-			sent = true
-			break
+			return sock
 		}
 	}
 
-	if !sent {
+	return nil
+}
+
+func (b *bus) send(p *Packet, dst string) error {
+	sock := b.lookup(dst)
+	if sock == nil {
 		b.thing.log.printf("Destination [%s] unknown: %.80s", dst, p.String())
+		return fmt.Errorf("Destination [%s] unknown", dst)
 	}
+
+	return b.sendSock(p, sock)
+}
+
+func (b *bus) sendSock(p *Packet, sock socketer) error {
+	var err error
+
+	b.intercept(p, DirSend, func(p *Packet) {
+		b.thing.log.printf("Send to [%s]: %.80s", sock.Src(), p.String())
+		err = b.sockSend(sock, b.sockQueue(sock), p)
+	})
+
+	return err
 }
 
 func (b *bus) close() {
 	b.sockLock.Lock()
 	defer b.sockLock.Unlock()
 
-	for sock := range b.sockets {
+	for sock, q := range b.sockets {
+		if q != nil {
+			q.stop()
+		}
 		sock.Close()
 		delete(b.sockets, sock)
 	}
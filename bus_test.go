@@ -0,0 +1,251 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, msg string
+		want         bool
+	}{
+		{"Sensor.*", "Sensor.Temp", true},
+		{"Sensor.*", "Sensor.Temp.Max", true},
+		{"Sensor.*", "Sensor.", true},
+		{"Sensor.*", "Sensor", false},
+		{"Relay/+", "Relay/1", true},
+		{"Relay/+", "Relay/", false},
+		{"Relay/+", "Relay/1/State", false},
+		{"Relay/+/State", "Relay/1/State", true},
+		{"*Click", "Click", true},
+		{"*Click", "DoubleClick", true},
+		{"+.Temp", "Sensor.Temp", true},
+		{"+.Temp", "a.b.Temp", false},
+	}
+
+	for _, test := range tests {
+		got := matchPattern(test.pattern, test.msg)
+		if got != test.want {
+			t.Errorf("matchPattern(%s, %s) = %t, want %t",
+				test.pattern, test.msg, got, test.want)
+		}
+	}
+}
+
+func TestSubscriberPrecedence(t *testing.T) {
+	var got string
+
+	handler := func(key string) func(*Packet) {
+		return func(p *Packet) { got = key }
+	}
+
+	subs := Subscribers{
+		"Relay/0":        handler("Relay/0"),
+		"Relay/+":        handler("Relay/+"),
+		"Relay/*":        handler("Relay/*"),
+		"*":              handler("*"),
+		"Relay/+/State":  handler("Relay/+/State"),
+		"Sensor.Temp.*":  handler("Sensor.Temp.*"),
+		"Sensor.*":       handler("Sensor.*"),
+		"Sensor.Silence": nil,
+	}
+
+	thing := NewThing(&sparse{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+	thing.bus = newBus(thing, 1, subs)
+
+	tests := []struct{ msg, want string }{
+		{"Relay/0", "Relay/0"},
+		{"Relay/1", "Relay/+"},
+		{"Relay/1/State", "Relay/+/State"},
+		{"Relay/1/Other", "Relay/*"},
+		{"Sensor.Temp.Max", "Sensor.Temp.*"},
+		{"Sensor.Pressure", "Sensor.*"},
+		{"Sensor.Silence", ""},
+		{"Other", "*"},
+	}
+
+	for _, test := range tests {
+		got = ""
+		thing.Inject(&Msg{Msg: test.msg})
+		if got != test.want {
+			t.Errorf("Msg %s matched %s, want %s", test.msg, got, test.want)
+		}
+	}
+}
+
+type msgAlarm struct {
+	Msg   string
+	Level int
+}
+
+func TestRetain(t *testing.T) {
+	thing := NewThing(&empty{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+
+	thing.NewPacket(&msgAlarm{Msg: "Alarm", Level: 1}).Retain().Broadcast()
+	thing.NewPacket(&Msg{Msg: "Door"}).Retain().Broadcast()
+	thing.NewPacket(&msgAlarm{Msg: "Alarm", Level: 2}).Retain().Broadcast()
+	thing.Broadcast(&Msg{Msg: "Transient"})
+
+	conn, done := dialThing(t, thing)
+	defer done()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	conn.WriteJSON(&Msg{Msg: GetState})
+	var alarm msgAlarm
+	for _, want := range []msgAlarm{{ReplyState, 0}, {"Alarm", 2}, {"Door", 0}} {
+		alarm = msgAlarm{}
+		if err := conn.ReadJSON(&alarm); err != nil {
+			t.Fatalf("Read %s failed: %s", want.Msg, err)
+		}
+		if alarm != want {
+			t.Errorf("Got %+v, want %+v", alarm, want)
+		}
+	}
+
+	// Replayed only once, on the ReplyState handshake
+	conn.WriteJSON(&Msg{Msg: GetState})
+	for _, want := range []string{ReplyState, "Next"} {
+		var msg Msg
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Read %s failed: %s", want, err)
+		}
+		if msg.Msg != want {
+			t.Errorf("Got %s, want %s", msg.Msg, want)
+		}
+		if msg.Msg == ReplyState {
+			thing.Broadcast(&Msg{Msg: "Next"})
+		}
+	}
+	// System sockets aren't plugged into the bus, so aren't enabled for
+	// broadcasts (or replayed to) on ReplyState
+	sys := newSysSocket("STORE")
+	thing.bus.receive(newPacket(thing.bus, sys, &Msg{Msg: GetState}))
+	if sys.Flags()&sock_flag_bcast != 0 {
+		t.Errorf("System socket enabled for broadcasts")
+	}
+}
+
+// alarmSocket keeps the last Alarm level it was sent, and notes if the level
+// ever went backwards
+type alarmSocket struct {
+	sync.Mutex
+	name      string
+	flags     uint32
+	level     int
+	backwards bool
+}
+
+func (s *alarmSocket) Send(p *Packet) error {
+	var alarm msgAlarm
+	p.Unmarshal(&alarm)
+	// Dawdle, as a real socket would, so racing sends interleave
+	time.Sleep(20 * time.Microsecond)
+	s.Lock()
+	if alarm.Level < s.level {
+		s.backwards = true
+	}
+	s.level = alarm.Level
+	s.Unlock()
+	return nil
+}
+
+func (s *alarmSocket) Close()                {}
+func (s *alarmSocket) Name() string          { return s.name }
+func (s *alarmSocket) Flags() uint32         { return s.flags }
+func (s *alarmSocket) SetFlags(flags uint32) { s.flags = flags }
+func (s *alarmSocket) Src() string           { return s.name }
+
+// Sockets enabled for broadcasts while a retained message is being broadcast
+// get the replay and the broadcasts in order, and end up with the last value,
+// not a stale replayed one
+func TestRetainReplayOrder(t *testing.T) {
+	const sockets = 50
+	const levels = 200
+
+	thing := NewThing(&empty{})
+	thing.Cfg.Id = testId
+	thing.Cfg.LoggingEnabled = false
+	thing.Cfg.MaxConnections = sockets
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+
+	thing.NewPacket(&msgAlarm{Msg: "Alarm", Level: 0}).Retain().Broadcast()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for level := 1; level <= levels; level++ {
+			thing.NewPacket(&msgAlarm{Msg: "Alarm", Level: level}).
+				Retain().Broadcast()
+		}
+	}()
+
+	socks := make([]*alarmSocket, sockets)
+	for i := range socks {
+		socks[i] = &alarmSocket{name: "sock" + strconv.Itoa(i), level: -1}
+		thing.bus.plugin(socks[i])
+		wg.Add(1)
+		go func(sock *alarmSocket) {
+			defer wg.Done()
+			thing.bus.enableBroadcast(sock)
+		}(socks[i])
+	}
+
+	wg.Wait()
+
+	for _, sock := range socks {
+		if sock.backwards {
+			t.Errorf("Socket %s got Alarm levels out of order",
+				sock.name)
+		}
+		if sock.level != levels {
+			t.Errorf("Socket %s ended with Alarm level %d, want %d",
+				sock.name, sock.level, levels)
+		}
+	}
+}
+
+// Cmd messages from a socket are dropped, so the far end can't stop Thing
+func TestCmdFromSocket(t *testing.T) {
+	var stops int
+
+	thing := NewThing(&empty{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+	thing.bus.subscribe(CmdStop, func(p *Packet) { stops++ })
+
+	sock := &alarmSocket{name: "sock"}
+	thing.bus.plugin(sock)
+	thing.bus.receive(newPacket(thing.bus, sock, &Msg{Msg: CmdStop}))
+	if stops != 0 {
+		t.Errorf("CmdStop from socket received")
+	}
+
+	thing.Inject(&Msg{Msg: CmdStop})
+	if stops != 1 {
+		t.Errorf("Injected CmdStop not received")
+	}
+}
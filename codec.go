@@ -0,0 +1,98 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+import (
+	"sort"
+	"sync"
+)
+
+// A Codec encodes and decodes messages on the wire between a Thing and its
+// Thing Prime or bridge.
+//
+// Messages on a Thing's bus are always JSON-encoded; Packet.Marshal() and
+// Packet.Unmarshal() work the same regardless of Codec.  The Codec only
+// applies to the websocket connection to Thing Prime or bridge: messages are
+// transcoded from JSON to the Codec when sent, and back to JSON when
+// received.  Codec-encoded messages are sent as binary websocket messages,
+// JSON-encoded messages as text websocket messages.
+//
+// The Codec is negotiated per connection in the identity handshake.  Thing
+// Prime or bridge offers the Codecs it knows in GetIdentity, and the Thing
+// picks its configured ThingConfig.Codec, if offered.  Otherwise, the
+// connection stays JSON.  Browsers always get JSON.
+//
+// Merle includes "json", "cbor" and "msgpack" Codecs.  Register other Codecs
+// with RegisterCodec().
+type Codec interface {
+	// Codec name, as negotiated in the identity handshake; e.g. "cbor"
+	Name() string
+	// Encode v
+	Marshal(v interface{}) ([]byte, error)
+	// Decode data into v
+	Unmarshal(data []byte, v interface{}) error
+}
+
+const codecJSON = "json"
+
+type jsonCodec struct {
+}
+
+func (c jsonCodec) Name() string {
+	return codecJSON
+}
+
+func (c jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return jsonMarshal(v)
+}
+
+func (c jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return jsonUnmarshal(data, v)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	byName map[string]Codec
+}{
+	byName: map[string]Codec{codecJSON: jsonCodec{}},
+}
+
+// RegisterCodec makes Codec c available for negotiation, by c.Name().  A
+// Codec registered with the same name as an existing Codec replaces the
+// existing Codec.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byName[c.Name()] = c
+}
+
+// Codec registered by name, or nil if not registered
+func lookupCodec(name string) Codec {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	return codecs.byName[name]
+}
+
+// Names of registered Codecs, in order of preference: preferred first, JSON
+// last, and the rest in lexical order.
+func codecNames(preferred string) []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	var names []string
+
+	for name := range codecs.byName {
+		if name != preferred && name != codecJSON {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if _, ok := codecs.byName[preferred]; ok && preferred != codecJSON {
+		names = append([]string{preferred}, names...)
+	}
+
+	return append(names, codecJSON)
+}
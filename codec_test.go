@@ -0,0 +1,136 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCodecNames(t *testing.T) {
+	want := []string{"msgpack", "cbor", "json"}
+	if got := codecNames("msgpack"); !reflect.DeepEqual(got, want) {
+		t.Errorf("codecNames = %v, want %v", got, want)
+	}
+
+	want = []string{"cbor", "msgpack", "json"}
+	if got := codecNames("json"); !reflect.DeepEqual(got, want) {
+		t.Errorf("codecNames = %v, want %v", got, want)
+	}
+}
+
+func TestCodecTranscode(t *testing.T) {
+	msg := []byte(`{"Msg":"Update","Lat":38.8977,"Long":-77.0365,` +
+		`"Sats":7,"Fix":true,"Ids":[1,2,3],"Name":"gps"}`)
+
+	var want interface{}
+	json.Unmarshal(msg, &want)
+
+	for _, name := range []string{"cbor", "msgpack"} {
+		c := lookupCodec(name)
+
+		data, err := encodeMsg(c, msg)
+		if err != nil {
+			t.Fatalf("%s encode failed: %s", name, err)
+		}
+		if len(data) >= len(msg) {
+			t.Errorf("%s encoded %d bytes, want less than %d", name,
+				len(data), len(msg))
+		}
+
+		back, err := decodeMsg(c, data)
+		if err != nil {
+			t.Fatalf("%s decode failed: %s", name, err)
+		}
+
+		var got interface{}
+		json.Unmarshal(back, &got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s round-trip got %s, want %s", name, back, msg)
+		}
+	}
+}
+
+func TestCodecNegotiate(t *testing.T) {
+	thing := NewThing(&empty{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Codec = "cbor"
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+
+	conn, done := dialThing(t, thing)
+	defer done()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	// Identity handshake is JSON
+	conn.WriteJSON(&MsgGetIdentity{Msg: GetIdentity,
+		Codecs: []string{"msgpack", "cbor", "json"}})
+	var identity MsgIdentity
+	if err := conn.ReadJSON(&identity); err != nil {
+		t.Fatalf("Read identity failed: %s", err)
+	}
+	if identity.Codec != "cbor" {
+		t.Fatalf("Negotiated %s, want cbor", identity.Codec)
+	}
+
+	// Then it's CBOR both ways
+	codec := lookupCodec("cbor")
+	req, _ := codec.Marshal(&Msg{Msg: GetState})
+	conn.WriteMessage(websocket.BinaryMessage, req)
+
+	mt, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Read state failed: %s", err)
+	}
+	if mt != websocket.BinaryMessage {
+		t.Fatalf("Got message type %d, want binary", mt)
+	}
+	var msg Msg
+	if err := codec.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("Decode state failed: %s", err)
+	}
+	if msg.Msg != ReplyState {
+		t.Errorf("Got %s, want %s", msg.Msg, ReplyState)
+	}
+}
+
+func TestCodecNegotiateFallback(t *testing.T) {
+	thing := NewThing(&empty{})
+	thing.Cfg.Id = testId
+	thing.Cfg.Codec = "cbor"
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+
+	conn, done := dialThing(t, thing)
+	defer done()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	// A peer without codecs gets JSON
+	conn.WriteJSON(&Msg{Msg: GetIdentity})
+	var identity MsgIdentity
+	if err := conn.ReadJSON(&identity); err != nil {
+		t.Fatalf("Read identity failed: %s", err)
+	}
+	if identity.Codec != "" {
+		t.Errorf("Negotiated %s, want none", identity.Codec)
+	}
+
+	conn.WriteJSON(&Msg{Msg: GetState})
+	mt, _, err := conn.ReadMessage()
+	if err != nil || mt != websocket.TextMessage {
+		t.Errorf("Got message type %d (%v), want text", mt, err)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// CBOR (RFC 8949) codec
+type cborCodec struct {
+	dec cbor.DecMode
+}
+
+func newCborCodec() *cborCodec {
+	// Decode maps as map[string]interface{}, like encoding/json, so
+	// decoded messages can be transcoded back to JSON
+	dec, _ := cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+	return &cborCodec{dec: dec}
+}
+
+func (c *cborCodec) Name() string {
+	return "cbor"
+}
+
+func (c *cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (c *cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return c.dec.Unmarshal(data, v)
+}
+
+// MessagePack codec
+type msgpackCodec struct {
+}
+
+func (c msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (c msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	// Encode ints and floats in as few bytes as possible, without loss
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseCompactInts(true)
+	enc.UseCompactFloats(true)
+
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+func init() {
+	RegisterCodec(newCborCodec())
+	RegisterCodec(msgpackCodec{})
+}
+
+// Replace JSON numbers with int64, if integral, or float64, so they encode
+// compactly in the codec
+func jsonNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = jsonNumbers(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = jsonNumbers(val)
+		}
+	}
+	return v
+}
+
+// Transcode JSON-encoded msg to codec c
+func encodeMsg(c Codec, msg []byte) ([]byte, error) {
+	var v interface{}
+
+	d := json.NewDecoder(bytes.NewReader(msg))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return c.Marshal(jsonNumbers(v))
+}
+
+// Transcode codec c-encoded data to JSON
+func decodeMsg(c Codec, data []byte) ([]byte, error) {
+	var v interface{}
+
+	if err := c.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+// A codecSocket is a socket which can encode messages on the wire with a
+// Codec
+type codecSocket interface {
+	// Set socket's codec.  Received messages are decoded with the codec
+	// right away, but sent messages are encoded with the codec only if
+	// send is true, or once the first codec-encoded message is received.
+	setCodec(c Codec, send bool)
+}
+
+// Pick the codec for the connection from the codecs offered in GetIdentity.
+// The socket the GetIdentity came in on is set to use the codec.
+func (t *Thing) negotiateCodec(p *Packet) string {
+	var req MsgGetIdentity
+
+	if err := p.Unmarshal(&req); err != nil || len(req.Codecs) == 0 {
+		// Peer doesn't know about codecs
+		return ""
+	}
+
+	name := codecJSON
+	for _, offered := range req.Codecs {
+		if offered == t.Cfg.Codec && lookupCodec(offered) != nil {
+			name = offered
+			break
+		}
+	}
+
+	if sock, ok := p.src.(codecSocket); ok && name != codecJSON {
+		sock.setCodec(lookupCodec(name), false)
+	}
+
+	t.log.printf("Codec [%s] negotiated with [%s]", name, p.SrcName())
+
+	return name
+}
+
+// Codec chosen by Thing in ReplyIdentity.  Nil means JSON.
+func identityCodec(msg *MsgIdentity) (Codec, error) {
+	if msg.Codec == "" || msg.Codec == codecJSON {
+		return nil, nil
+	}
+	c := lookupCodec(msg.Codec)
+	if c == nil {
+		return nil, fmt.Errorf("Unknown codec %s", msg.Codec)
+	}
+	return c, nil
+}
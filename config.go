@@ -57,6 +57,16 @@ type ThingConfig struct {
 	// websocket over HTTP.  The default is 0 (no web server).
 	PortPrivate uint
 
+	// [Optional] If AttachToken is set, and Thing is a bridge or Thing
+	// Prime, children can dial in to Thing's public HTTPS server to
+	// attach, rather than coming in on an SSH tunnel (see
+	// MotherTransport).  A child must present AttachToken to attach.  A
+	// bridge's children on TinyGo, which attach on the bridge's private
+	// HTTP server, must present AttachToken too.  The default is ""
+	// (children can't dial in to the public HTTPS server, and the private
+	// HTTP server is trusted: any child can attach there).
+	AttachToken string
+
 	// [Optional] Run as Thing-prime.  The default is false.
 	IsPrime bool
 
@@ -72,9 +82,66 @@ type ThingConfig struct {
 	// waiting for one of the first 30 WebSocket sessions to terminate.
 	MaxConnections uint
 
+	// [Optional] If WebSocketCompress is true, Thing's websockets
+	// compress messages (permessage-deflate), if the other end, say a
+	// browser, agrees.  Compression trades CPU for bandwidth.  With
+	// compression, a message broadcast to many websockets is compressed
+	// once rather than once for each websocket.  The default is false.
+	WebSocketCompress bool
+
 	// Logging enable
 	LoggingEnabled bool
 
+	// [Optional] Middleware to intercept Packets on Thing's bus.  See
+	// Middleware.  The default is no middleware.
+	Middleware []Middleware
+
+	// [Optional] If AsyncDispatch is true, each socket plugged into
+	// Thing's bus gets its own inbound and outbound Packet queues.
+	// Received Packets are dispatched to Subscribers() from the socket's
+	// inbound queue, and sent Packets are written to the socket from the
+	// socket's outbound queue, each on its own go func.  A slow
+	// subscriber handler or a slow connection then only stalls its own
+	// socket.  If AsyncDispatch is false, Packets are dispatched on the
+	// go func reading the socket, and sent on the go func sending.  The
+	// default is false.
+	AsyncDispatch bool
+
+	// Depth of each socket's inbound and outbound queues, if
+	// AsyncDispatch.  The default is 32.
+	QueueDepth uint
+
+	// What to do when a socket's queue is full, if AsyncDispatch.  The
+	// default is QueueBlock, to block the sender until there is room in
+	// the queue.
+	QueuePolicy QueuePolicy
+
+	// [Optional] Codec to use on the wire to Thing Prime or bridge; one
+	// of "json", "cbor", "msgpack", or the name of a Codec registered
+	// with RegisterCodec().  The Codec is negotiated when Thing Prime or
+	// bridge connects, so Thing falls back to "json" if the other end
+	// doesn't know the Codec.  On Thing Prime or bridge, Codec is the
+	// preferred Codec to offer.  See Codec.  The default is "json".
+	Codec string
+
+	// [Optional] Directory for Thing's persistent state store.  If
+	// StateDir is set, Thing's state is saved to a file in StateDir
+	// after changes, and the saved state is handed to the CmdInit
+	// handler when Thing restarts (see Packet.RestoreState()).  The
+	// state saved is the state Thing replies with to GetState.  On Thing
+	// Prime, Prime's last known copy of Thing's state is saved, and
+	// restored to Prime's Subscribers() as a ReplyState on startup.
+	// Thing's file is named by Id, and Prime's by Model, so Primes of
+	// the same Model need their own StateDir.  The default is "" (no
+	// state store).
+	StateDir string
+
+	// [Optional] File to record Thing's bus traffic to.  Every Packet
+	// passing through Thing's bus is appended to the file as a JSON line
+	// (see Record).  Play a recording back with thing.Replay().  The
+	// default is "" (no recording).
+	RecordFile string
+
 	// ########## Mother configuration.
 	//
 	// This section describes a Thing's mother.  Every Thing has a mother.  A
@@ -86,13 +153,69 @@ type ThingConfig struct {
 	// the internet.
 	MotherHost string
 
+	// [Optional] How Thing connects to Mother; one of "ssh" or "wss".
+	// With "ssh", Thing connects to Mother over an SSH tunnel, using the
+	// MotherUser and MotherKey* configuration below.  With "wss", Thing
+	// dials Mother's public HTTPS server on MotherPortWSS over a
+	// websocket, presenting MotherToken, and Mother, a bridge or Thing
+	// Prime, attaches Thing as if Thing came in on a port.  Use "wss"
+	// where SSH from Thing to Mother isn't allowed.  The default is
+	// "ssh".
+	MotherTransport string
+
 	// User on host with SSH access into host.  Host should be configured
 	// with user's public key so SSH access is password-less.
 	MotherUser string
 
-	// Port on Host for Mother's private HTTP server
+	// [Optional] Port for SSH on Host.  The default is 22.
+	MotherPortSSH uint
+
+	// [Optional] File with User's SSH private key.  RSA, ECDSA and
+	// Ed25519 keys are supported, in OpenSSH or PEM format.  The default
+	// is "", to try .ssh/id_ed25519, .ssh/id_ecdsa and .ssh/id_rsa in
+	// User's home directory, in that order.
+	MotherKeyFile string
+
+	// [Optional] Passphrase for an encrypted private key.
+	// MotherKeyPassphrase is called each time the encrypted key is read.
+	// For example, to read the passphrase from a file:
+	//
+	//	thing.Cfg.MotherKeyPassphrase = func() ([]byte, error) {
+	//		pass, err := os.ReadFile("/etc/merle/passphrase")
+	//		return bytes.TrimSpace(pass), err
+	//	}
+	//
+	// The default is nil (private key isn't encrypted).
+	MotherKeyPassphrase func() ([]byte, error)
+
+	// [Optional] known_hosts file to verify Host's SSH key with.  The
+	// default is "", for .ssh/known_hosts in User's home directory.
+	MotherKnownHosts string
+
+	// [Optional] If MotherSSHAgent is true, keys held by the ssh-agent
+	// listening on $SSH_AUTH_SOCK are tried before the private key
+	// file.  The default is false.
+	MotherSSHAgent bool
+
+	// Port on Host for Mother's private HTTP server.  On TinyGo, there is
+	// no SSH tunnel to Mother.  Instead, Thing dials Mother's private HTTP
+	// server on MotherHost:MotherPortPrivate directly, and Mother, a
+	// bridge, attaches Thing as a child.  MotherUser isn't used.
 	MotherPortPrivate uint
 
+	// [Optional] Port for Mother's public HTTPS server, if
+	// MotherTransport is "wss".  The default is 443.
+	MotherPortWSS uint
+
+	// Token Thing presents to Mother, if MotherTransport is "wss", or on
+	// TinyGo.  The token must match Mother's AttachToken.
+	MotherToken string
+
+	// [Optional] File with PEM certificates of CAs to verify Mother's
+	// HTTPS server certificate with, if MotherTransport is "wss".  The
+	// default is "", to use the system's CAs.
+	MotherRootCAs string
+
 	// ########## Bridge configuration.
 	//
 	// A Thing implementing the Bridger interface will use this config for
@@ -114,6 +237,10 @@ type ThingConfig struct {
 	//
 	// And then run sudo sysctl -p
 	//
+	// A bridge also attaches children which dial in to the bridge's
+	// private HTTP server directly, such as TinyGo Things.  Those
+	// children don't use a bridge port.
+	//
 	BridgePortBegin uint
 
 	// Ending bridge port number
@@ -128,13 +255,29 @@ var defaultCfg = ThingConfig{
 	PortPublic:        0,
 	PortPublicTLS:     0,
 	PortPrivate:       0,
+	AttachToken:       "",
 	IsPrime:           false,
 	PortPrime:         6001,
 	LoggingEnabled:    true,
 	MaxConnections:    30,
+	WebSocketCompress: false,
+	AsyncDispatch:     false,
+	QueueDepth:        32,
+	QueuePolicy:       QueueBlock,
+	Codec:             "json",
+	StateDir:          "",
+	RecordFile:        "",
 	MotherHost:        "",
+	MotherTransport:   "ssh",
 	MotherUser:        "",
+	MotherPortSSH:     22,
+	MotherKeyFile:     "",
+	MotherKnownHosts:  "",
+	MotherSSHAgent:    false,
 	MotherPortPrivate: 6000,
+	MotherPortWSS:     443,
+	MotherToken:       "",
+	MotherRootCAs:     "",
 	BridgePortBegin:   6001,
 	BridgePortEnd:     6100,
 }
@@ -3,91 +3,99 @@
 package bmp180
 
 import (
+	"errors"
+	"log"
 	"math"
-	"sync"
 	"time"
 
 	"github.com/merliot/merle"
-	"gobot.io/x/gobot/drivers/i2c"
-	"gobot.io/x/gobot/platforms/raspi"
+	"github.com/merliot/merle/hal"
 )
 
+// I2C bus the sensor is on (/dev/i2c-1 on a Raspberry Pi)
+const i2cBus = 1
+
 type Bmp180 struct {
-	sync.Mutex
-	driver      *i2c.BMP180Driver
-	Msg         string
+	merle.State
+	backend     hal.Backend
+	sensor      *sensor
+	poller      *merle.Poller
 	Temperature int
 	Pressure    int
 }
 
 func NewBmp180() *Bmp180 {
-	return &Bmp180{}
+	return NewBmp180On(hal.NewLinux())
 }
 
-func (b *Bmp180) init(p *merle.Packet) {
-	adaptor := raspi.NewAdaptor()
-	adaptor.Connect()
-	b.driver = i2c.NewBMP180Driver(adaptor)
-	b.driver.Start()
+// NewBmp180On returns Bmp180 reading the sensor through backend
+func NewBmp180On(backend hal.Backend) *Bmp180 {
+	b := &Bmp180{backend: backend}
+	b.poller = &merle.Poller{
+		Locker:   b,
+		State:    b,
+		Read:     b.read,
+		Interval: time.Second,
+	}
+	return b
 }
 
-func (b *Bmp180) run(p *merle.Packet) {
-	for {
-		var changed bool = false
+func (b *Bmp180) init(p *merle.Packet) {
+	dev, err := b.backend.I2C(i2cBus, sensorAddr)
+	if err != nil {
+		log.Println("Opening BMP180 failed:", err)
+		return
+	}
+	b.sensor, err = newSensor(dev)
+	if err != nil {
+		log.Println("Calibrating BMP180 failed:", err)
+		dev.Close()
+	}
+}
 
-		temp, _ := b.driver.Temperature()
-		pres, _ := b.driver.Pressure()
+func (b *Bmp180) stop(p *merle.Packet) {
+	b.poller.Stop()
+	if b.sensor != nil {
+		b.sensor.close()
+	}
+}
 
-		temp = (temp * 1.8) + 32.0
-		pres = pres / 1000.0
+var errNoSensor = errors.New("BMP180 not opened")
 
-		newTemp := int(math.Round(float64(temp)))
-		newPres := int(math.Round(float64(pres)))
+// Read temperature (F) and pressure (kPa).  Called by the poller, with b
+// locked.
+func (b *Bmp180) read() error {
+	if b.sensor == nil {
+		return errNoSensor
+	}
 
-		b.Lock()
-		if newTemp != b.Temperature || newPres != b.Pressure {
-			b.Msg = "Update"
-			b.Temperature = newTemp
-			b.Pressure = newPres
-			p.Marshal(b)
-			changed = true
-		}
-		b.Unlock()
+	temp, pres, err := b.sensor.read()
+	if err != nil {
+		return err
+	}
 
-		if changed {
-			p.Broadcast()
-		}
+	temp = (temp * 1.8) + 32.0
+	pres = pres / 1000.0
 
-		time.Sleep(time.Second)
-	}
-}
+	b.Temperature = int(math.Round(temp))
+	b.Pressure = int(math.Round(pres))
 
-func (b *Bmp180) getState(p *merle.Packet) {
-	b.Lock()
-	b.Msg = merle.ReplyState
-	p.Marshal(b)
-	b.Unlock()
-	p.Reply()
+	return nil
 }
 
-func (b *Bmp180) saveState(p *merle.Packet) {
+func (b *Bmp180) update(p *merle.Packet) {
 	b.Lock()
 	p.Unmarshal(b)
 	b.Unlock()
-}
-
-func (b *Bmp180) update(p *merle.Packet) {
-	b.saveState(p)
 	p.Broadcast()
 }
 
 func (b *Bmp180) Subscribers() merle.Subscribers {
 	return merle.Subscribers{
-		merle.CmdInit:    b.init,
-		merle.CmdRun:     b.run,
-		merle.GetState:   b.getState,
-		merle.ReplyState: b.saveState,
-		"Update":         b.update,
+		merle.CmdInit: b.init,
+		merle.CmdRun:  b.poller.Run,
+		merle.CmdStop: b.stop,
+		"Update":      b.update,
 	}
 }
 
@@ -0,0 +1,88 @@
+// file: examples/bmp180/bmp180_test.go
+
+package bmp180
+
+import (
+	"testing"
+
+	"github.com/merliot/merle"
+	"github.com/merliot/merle/hal"
+	"github.com/merliot/merle/merletest"
+)
+
+// Script a BMP180 on mock with the datasheet's example calibration and
+// readings: 15.0C and 69964Pa
+func mockSensor(mock *hal.Mock) *hal.MockI2C {
+	dev := mock.Device(i2cBus, sensorAddr)
+	dev.SetRegs(regCalib,
+		0x01, 0x98, // AC1 408
+		0xff, 0xb8, // AC2 -72
+		0xc7, 0xd1, // AC3 -14383
+		0x7f, 0xe5, // AC4 32741
+		0x7f, 0xf5, // AC5 32757
+		0x5a, 0x71, // AC6 23153
+		0x18, 0x2e, // B1 6190
+		0x00, 0x04, // B2 4
+		0x80, 0x00, // MB -32768
+		0xdd, 0xf9, // MC -8711
+		0x0b, 0x34, // MD 2868
+	)
+	dev.OnWrite(func(d *hal.MockI2C, reg byte, data []byte) {
+		if reg != regControl {
+			return
+		}
+		switch data[0] {
+		case cmdTemp:
+			d.SetRegs(regData, 0x6c, 0xfa) // UT 27898
+		case cmdPres | oversampling<<6:
+			d.SetRegs(regData, 0x5d, 0x23, 0x00) // UP 23843
+		}
+	})
+	return dev
+}
+
+func TestSensor(t *testing.T) {
+	mock := hal.NewMock()
+	mockSensor(mock)
+
+	dev, _ := mock.I2C(i2cBus, sensorAddr)
+	s, err := newSensor(dev)
+	if err != nil {
+		t.Fatalf("newSensor: %s", err)
+	}
+
+	temp, pres, err := s.read()
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if temp != 15.0 || pres != 69964 {
+		t.Errorf("Read %.1fC %.0fPa, want 15.0C 69964Pa", temp, pres)
+	}
+}
+
+func TestBmp180(t *testing.T) {
+	mock := hal.NewMock()
+	mockSensor(mock)
+
+	h := merletest.New(t, NewBmp180On(mock))
+
+	browser := h.Socket("browser")
+	browser.Handshake()
+
+	ran := make(chan bool)
+	go func() {
+		h.Thing.Inject(&merle.Msg{Msg: merle.CmdRun})
+		close(ran)
+	}()
+
+	var update Bmp180
+	browser.Expect("Update", &update)
+	if update.Temperature != 59 || update.Pressure != 70 {
+		t.Errorf("Update %dF %dkPa, want 59F 70kPa",
+			update.Temperature, update.Pressure)
+	}
+
+	// CmdStop stops the poller
+	h.Thing.Inject(&merle.Msg{Msg: merle.CmdStop})
+	<-ran
+}
@@ -0,0 +1,122 @@
+// file: examples/bmp180/sensor.go
+
+package bmp180
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/merliot/merle/hal"
+)
+
+// BMP180 I2C address and registers (see the Bosch BMP180 datasheet)
+const (
+	sensorAddr    = 0x77
+	regCalib      = 0xAA
+	regControl    = 0xF4
+	regData       = 0xF6
+	cmdTemp       = 0x2E
+	cmdPres       = 0x34
+	oversampling  = 0 // ultra low power
+	convWait      = 5 * time.Millisecond
+	calibrateSize = 22
+)
+
+// sensor is a BMP180 temperature and pressure sensor on I2C
+type sensor struct {
+	dev hal.I2C
+	// Calibration coefficients, read from the sensor's EEPROM
+	ac1, ac2, ac3 int32
+	ac4, ac5, ac6 int32
+	b1, b2        int32
+	mb, mc, md    int32
+}
+
+func newSensor(dev hal.I2C) (*sensor, error) {
+	s := &sensor{dev: dev}
+	if err := s.calibrate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sensor) calibrate() error {
+	var buf [calibrateSize]byte
+	if err := s.dev.ReadReg(regCalib, buf[:]); err != nil {
+		return err
+	}
+
+	signed := func(i int) int32 {
+		return int32(int16(binary.BigEndian.Uint16(buf[i*2:])))
+	}
+	unsigned := func(i int) int32 {
+		return int32(binary.BigEndian.Uint16(buf[i*2:]))
+	}
+
+	s.ac1, s.ac2, s.ac3 = signed(0), signed(1), signed(2)
+	s.ac4, s.ac5, s.ac6 = unsigned(3), unsigned(4), unsigned(5)
+	s.b1, s.b2 = signed(6), signed(7)
+	s.mb, s.mc, s.md = signed(8), signed(9), signed(10)
+
+	return nil
+}
+
+// Start a conversion with cmd, wait for it, and read the result into buf
+func (s *sensor) convert(cmd byte, buf []byte) error {
+	if err := s.dev.WriteReg(regControl, []byte{cmd}); err != nil {
+		return err
+	}
+	time.Sleep(convWait)
+	return s.dev.ReadReg(regData, buf)
+}
+
+// Read temperature (C) and pressure (Pa)
+func (s *sensor) read() (temp float64, pres float64, err error) {
+	var buf [3]byte
+
+	if err = s.convert(cmdTemp, buf[:2]); err != nil {
+		return
+	}
+	ut := int32(binary.BigEndian.Uint16(buf[:]))
+
+	if err = s.convert(cmdPres|oversampling<<6, buf[:]); err != nil {
+		return
+	}
+	up := (int32(buf[0])<<16 | int32(buf[1])<<8 | int32(buf[2])) >>
+		(8 - oversampling)
+
+	// Compensation, straight from the datasheet
+
+	x1 := (ut - s.ac6) * s.ac5 >> 15
+	x2 := s.mc << 11 / (x1 + s.md)
+	b5 := x1 + x2
+	temp = float64((b5+8)>>4) / 10.0
+
+	b6 := b5 - 4000
+	x1 = (s.b2 * (b6 * b6 >> 12)) >> 11
+	x2 = s.ac2 * b6 >> 11
+	x3 := x1 + x2
+	b3 := (((s.ac1*4 + x3) << oversampling) + 2) / 4
+	x1 = s.ac3 * b6 >> 13
+	x2 = (s.b1 * (b6 * b6 >> 12)) >> 16
+	x3 = ((x1 + x2) + 2) >> 2
+	b4 := uint32(s.ac4) * uint32(x3+32768) >> 15
+	b7 := uint32(up-b3) * (50000 >> oversampling)
+
+	var p int32
+	if b7 < 0x80000000 {
+		p = int32(b7 * 2 / b4)
+	} else {
+		p = int32(b7 / b4 * 2)
+	}
+	x1 = (p >> 8) * (p >> 8)
+	x1 = (x1 * 3038) >> 16
+	x2 = (-7357 * p) >> 16
+	pres = float64(p + (x1+x2+3791)>>4)
+
+	return
+}
+
+func (s *sensor) close() error {
+	return s.dev.Close()
+}
@@ -25,6 +25,7 @@ func main() {
 	flag.StringVar(&thing.Cfg.MotherUser, "ruser", "merle", "Remote user")
 	flag.BoolVar(&thing.Cfg.IsPrime, "prime", false, "Run as Thing Prime")
 	flag.UintVar(&thing.Cfg.PortPublicTLS, "TLS", 0, "TLS port")
+	flag.StringVar(&thing.Cfg.RecordFile, "record", "", "Record bus to file")
 
 	flag.Parse()
 
@@ -13,13 +13,25 @@ import (
 
 type gps struct {
 	sync.Mutex
+	telit    telit.Telit
+	loc      msg
+	poller   *merle.Poller
+	done     chan bool
+	doneOnce sync.Once
 	lastLat  float64
 	lastLong float64
 	Demo     bool
 }
 
 func NewGps() *gps {
-	return &gps{}
+	g := &gps{done: make(chan bool)}
+	g.poller = &merle.Poller{
+		Locker:   g,
+		State:    &g.loc,
+		Read:     g.read,
+		Interval: time.Minute,
+	}
+	return g
 }
 
 type msg struct {
@@ -28,35 +40,26 @@ type msg struct {
 	Long float64
 }
 
-func (g *gps) run(p *merle.Packet) {
-	var telit telit.Telit
-	msg := &msg{Msg: "Update"}
+// Read location.  Called by the poller, with g locked.
+func (g *gps) read() error {
+	g.loc.Lat, g.loc.Long = g.telit.Location()
+	g.lastLat, g.lastLong = g.loc.Lat, g.loc.Long
+	return nil
+}
 
-	err := telit.Init()
+func (g *gps) run(p *merle.Packet) {
+	err := g.telit.Init()
 	if err != nil {
 		log.Fatalln("Telit init failed:", err)
 		return
 	}
 
-	for {
-		msg.Lat, msg.Long = telit.Location()
-
-		g.Lock()
-		changed := false
-		if msg.Lat != g.lastLat || msg.Long != g.lastLong {
-			g.lastLat = msg.Lat
-			g.lastLong = msg.Long
-			p.Marshal(&msg)
-			changed = true
-		}
-		g.Unlock()
-
-		if changed {
-			p.Broadcast()
-		}
+	g.poller.Run(p)
+}
 
-		time.Sleep(time.Minute)
-	}
+func (g *gps) stop(p *merle.Packet) {
+	g.poller.Stop()
+	g.doneOnce.Do(func() { close(g.done) })
 }
 
 type place struct {
@@ -174,8 +177,9 @@ var places = [...]place{
 }
 
 func (g *gps) runDemo(p *merle.Packet) {
+	thing := p.Thing()
 	msg := &msg{Msg: "Update"}
-	p.Marshal(&msg).Broadcast()
+	thing.Broadcast(msg)
 
 	i := 0
 	for {
@@ -185,11 +189,16 @@ func (g *gps) runDemo(p *merle.Packet) {
 		g.Lock()
 		g.lastLat = places[i].lat
 		g.lastLong = places[i].long
-		p.Marshal(&msg)
 		g.Unlock()
 
-		p.Broadcast()
-		time.Sleep(time.Minute)
+		thing.Broadcast(msg)
+
+		select {
+		case <-g.done:
+			return
+		case <-time.After(time.Minute):
+		}
+
 		i = (i + 1) % len(places)
 	}
 }
@@ -219,6 +228,7 @@ func (g *gps) update(p *merle.Packet) {
 func (g *gps) Subscribers() merle.Subscribers {
 	subs := merle.Subscribers{
 		merle.CmdRun:     g.run,
+		merle.CmdStop:    g.stop,
 		merle.GetState:   g.getState,
 		merle.ReplyState: g.saveState,
 		"Update":         g.update,
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/merliot/merle"
 	"github.com/merliot/merle/examples/relays"
@@ -25,5 +29,16 @@ func main() {
 
 	flag.Parse()
 
-	log.Fatalln(thing.Run())
+	// Stop cleanly on SIGINT/SIGTERM (e.g. systemctl stop)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		cancel()
+	}()
+
+	if err := thing.RunContext(ctx); err != nil {
+		log.Fatalln(err)
+	}
 }
@@ -3,53 +3,50 @@
 package relays
 
 import (
-	"sync"
+	"log"
 
 	"github.com/merliot/merle"
-	"gobot.io/x/gobot/drivers/gpio"
-	"gobot.io/x/gobot/platforms/raspi"
+	"github.com/merliot/merle/hal"
 )
 
+// Relay GPIO pins (header pins 31, 33, 35, 37 on a Raspberry Pi)
+var pins = [4]int{6, 13, 19, 26}
+
 type Relays struct {
-	sync.Mutex
-	drivers [4]*gpio.RelayDriver
-	Msg     string
+	merle.State
+	backend hal.Backend
+	relays  [4]hal.DigitalOut
 	States  [4]bool
 }
 
 func NewRelays() merle.Thinger {
-	return &Relays{}
+	return NewRelaysOn(hal.NewLinux())
 }
 
-func (r *Relays) run(p *merle.Packet) {
-	adaptor := raspi.NewAdaptor()
-	adaptor.Connect()
-
-	r.drivers[0] = gpio.NewRelayDriver(adaptor, "31") // GPIO 6
-	r.drivers[1] = gpio.NewRelayDriver(adaptor, "33") // GPIO 13
-	r.drivers[2] = gpio.NewRelayDriver(adaptor, "35") // GPIO 19
-	r.drivers[3] = gpio.NewRelayDriver(adaptor, "37") // GPIO 26
-
-	for _, driver := range r.drivers {
-		driver.Start()
-		driver.Off()
-	}
-
-	select {}
+// NewRelaysOn returns Relays driving relays through backend
+func NewRelaysOn(backend hal.Backend) merle.Thinger {
+	return &Relays{backend: backend}
 }
 
-func (r *Relays) getState(p *merle.Packet) {
-	r.Lock()
-	r.Msg = merle.ReplyState
-	p.Marshal(r)
-	r.Unlock()
-	p.Reply()
+func (r *Relays) init(p *merle.Packet) {
+	for i, pin := range pins {
+		relay, err := r.backend.DigitalOut(pin)
+		if err != nil {
+			log.Println("Opening relay failed:", err)
+			continue
+		}
+		relay.Set(false)
+		r.relays[i] = relay
+	}
 }
 
-func (r *Relays) saveState(p *merle.Packet) {
-	r.Lock()
-	p.Unmarshal(r)
-	r.Unlock()
+func (r *Relays) stop(p *merle.Packet) {
+	// Leave the relays in a known (off) state on shutdown
+	for _, relay := range r.relays {
+		if relay != nil {
+			relay.Set(false)
+		}
+	}
 }
 
 type MsgClick struct {
@@ -58,20 +55,17 @@ type MsgClick struct {
 	State bool
 }
 
-func (r *Relays) click(p *merle.Packet) {
-	var msg MsgClick
-	p.Unmarshal(&msg)
+func (r *Relays) click(p *merle.Packet, msg *MsgClick) {
+	if msg.Relay < 0 || msg.Relay >= len(r.States) {
+		return
+	}
 
 	r.Lock()
 	r.States[msg.Relay] = msg.State
 	r.Unlock()
 
-	if p.IsThing() {
-		if msg.State {
-			r.drivers[msg.Relay].On()
-		} else {
-			r.drivers[msg.Relay].Off()
-		}
+	if p.IsThing() && r.relays[msg.Relay] != nil {
+		r.relays[msg.Relay].Set(msg.State)
 	}
 
 	p.Broadcast()
@@ -79,10 +73,10 @@ func (r *Relays) click(p *merle.Packet) {
 
 func (r *Relays) Subscribers() merle.Subscribers {
 	return merle.Subscribers{
-		merle.CmdRun:     r.run,
-		merle.GetState:   r.getState,
-		merle.ReplyState: r.saveState,
-		"Click":          r.click,
+		merle.CmdInit: r.init,
+		merle.CmdRun:  merle.RunForever,
+		merle.CmdStop: r.stop,
+		"Click":       merle.Handle(r.click),
 	}
 }
 
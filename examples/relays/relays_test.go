@@ -0,0 +1,70 @@
+// file: examples/relays/relays_test.go
+
+package relays
+
+import (
+	"testing"
+
+	"github.com/merliot/merle"
+	"github.com/merliot/merle/hal"
+	"github.com/merliot/merle/merletest"
+)
+
+func TestClick(t *testing.T) {
+	// Run as Thing Prime, which only tracks the relay states
+	h := merletest.New(t, NewRelays(), merletest.AsPrime())
+
+	real := h.Real()
+	real.Send(&Relays{State: merle.State{Msg: merle.ReplyState}})
+
+	browser := h.Socket("browser")
+	browser.Handshake()
+	other := h.Socket("other")
+	other.Handshake()
+
+	browser.Send(&MsgClick{Msg: "Click", Relay: 2, State: true})
+
+	// The click goes to the real Thing and to the other browser, but
+	// isn't echoed back
+	var click MsgClick
+	real.Expect("Click", &click)
+	if click.Relay != 2 || !click.State {
+		t.Errorf("Click %+v, want relay 2 on", click)
+	}
+	other.Expect("Click", nil)
+	browser.ExpectNone()
+
+	var state Relays
+	other.Send(&merle.Msg{Msg: merle.GetState})
+	other.Expect(merle.ReplyState, &state)
+	if state.States != [4]bool{false, false, true, false} {
+		t.Errorf("States %v, want relay 2 on", state.States)
+	}
+
+	// Out-of-range relays are ignored
+	browser.Send(&MsgClick{Msg: "Click", Relay: 4, State: true})
+	real.ExpectNone()
+}
+
+func TestRelays(t *testing.T) {
+	mock := hal.NewMock()
+	h := merletest.New(t, NewRelaysOn(mock))
+
+	browser := h.Socket("browser")
+	browser.Handshake()
+
+	browser.Send(&MsgClick{Msg: "Click", Relay: 0, State: true})
+	browser.Send(&MsgClick{Msg: "Click", Relay: 3, State: true})
+	browser.Send(&MsgClick{Msg: "Click", Relay: 0, State: false})
+
+	for i, pin := range pins {
+		if got, want := mock.Pin(pin).Level(), i == 3; got != want {
+			t.Errorf("Relay %d on %t, want %t", i, got, want)
+		}
+	}
+
+	h.Thing.Inject(&merle.Msg{Msg: merle.CmdStop})
+	if mock.Pin(pins[3]).Level() {
+		t.Errorf("Relay 3 still on after CmdStop")
+	}
+}
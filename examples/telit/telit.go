@@ -9,18 +9,21 @@ import (
 	"log"
 	"strconv"
 	"strings"
-	"time"
 
-	"github.com/tarm/serial"
+	"github.com/merliot/merle/hal"
 )
 
+// Telit modem's AT command port
+const modemPort = "/dev/ttyUSB3"
+
 type Telit struct {
-	modem *serial.Port
+	// Backend the modem is on.  The default is hal.NewLinux().
+	Backend hal.Backend
+	modem   hal.Serial
 }
 
 func (t *Telit) modemCmd(cmd string) (string, error) {
-	var buf = make([]byte, 128)
-	var res []byte
+	var lines []string
 	var err error
 
 	t.modem.Flush()
@@ -31,20 +34,20 @@ func (t *Telit) modemCmd(cmd string) (string, error) {
 	}
 
 	for {
-		var n int
+		var line string
 
-		n, err = t.modem.Read(buf)
-		if n == 0 { // timed-out; no more to read
+		line, err = t.modem.ReadLine()
+		if err == hal.ErrTimeout { // no more to read
 			err = nil
 			break
 		}
 		if err != nil {
 			return "", err
 		}
-		res = append(res, buf[:n]...)
+		lines = append(lines, line)
 	}
 
-	fields := strings.Fields(string(res))
+	fields := strings.Fields(strings.Join(lines, " "))
 	log.Printf("Telit modem response %q", fields)
 
 	if len(fields) < 2 {
@@ -67,9 +70,11 @@ func (t *Telit) modemCmd(cmd string) (string, error) {
 func (t *Telit) Init() error {
 	var err error
 
-	usb3 := &serial.Config{Name: "/dev/ttyUSB3", Baud: 115200,
-		ReadTimeout: time.Second / 2}
-	t.modem, err = serial.OpenPort(usb3)
+	if t.Backend == nil {
+		t.Backend = hal.NewLinux()
+	}
+
+	t.modem, err = t.Backend.Serial(modemPort, 115200)
 	if err != nil {
 		return err
 	}
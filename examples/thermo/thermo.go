@@ -189,6 +189,13 @@ func (t *thermo) init(p *merle.Packet) {
 	t.recalc = make(chan bool)
 	t.refresh = make(chan bool)
 	t.SetPoint = 68 // Nixon
+
+	// Pick up where we left off, if there is a saved state; the relays
+	// and sensors will report in with their own state
+	var saved thermo
+	if p.RestoreState(&saved) {
+		t.SetPoint = saved.SetPoint
+	}
 }
 
 func (t *thermo) marshal(p *merle.Packet) {
@@ -224,9 +231,7 @@ type MsgSetPoint struct {
 	Val int
 }
 
-func (t *thermo) setPoint(p *merle.Packet) {
-	var msg MsgSetPoint
-	p.Unmarshal(&msg)
+func (t *thermo) setPoint(p *merle.Packet, msg *MsgSetPoint) {
 	t.Lock()
 	t.SetPoint = msg.Val
 	t.Unlock()
@@ -244,7 +249,7 @@ func (t *thermo) Subscribers() merle.Subscribers {
 		merle.GetState:    t.getState,
 		merle.ReplyState:  t.saveState,
 		merle.EventStatus: nil,
-		"SetPoint":        t.setPoint,
+		"SetPoint":        merle.Handle(t.setPoint),
 	}
 }
 
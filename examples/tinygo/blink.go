@@ -9,6 +9,7 @@ package main
 
 import (
 	"machine"
+	"sync"
 	"time"
 
 	"github.com/merliot/merle"
@@ -18,7 +19,26 @@ import (
 const ssid = ""
 const pass = ""
 
+// Mother (bridge) info.  Mother's private HTTP server port is
+// thing.Cfg.MotherPortPrivate.
+const motherHost = ""
+
 type blinky struct {
+	sync.Mutex
+	Msg string
+	Led bool
+}
+
+// TinyGo has no encoding/json, so blinky marshals itself
+func (b *blinky) MarshalMerle(e *merle.Encoder) {
+	e.String("Msg", b.Msg)
+	e.Bool("Led", b.Led)
+}
+
+func (b *blinky) UnmarshalMerle(d *merle.Decoder) error {
+	d.String("Msg", &b.Msg)
+	d.Bool("Led", &b.Led)
+	return d.Err()
 }
 
 func (b *blinky) init(p *merle.Packet) {
@@ -29,18 +49,27 @@ func (b *blinky) run(p *merle.Packet) {
 	led := machine.LED
 	led.Configure(machine.PinConfig{Mode: machine.PinOutput})
 	for {
-		led.Low()
-		time.Sleep(time.Millisecond * 500)
-
-		led.High()
+		b.Lock()
+		b.Led = !b.Led
+		led.Set(b.Led)
+		b.Unlock()
 		time.Sleep(time.Millisecond * 500)
 	}
 }
 
+func (b *blinky) getState(p *merle.Packet) {
+	b.Lock()
+	b.Msg = merle.ReplyState
+	p.Marshal(b)
+	b.Unlock()
+	p.Reply()
+}
+
 func (b *blinky) Subscribers() merle.Subscribers {
 	return merle.Subscribers{
-		merle.CmdInit: b.init,
-		merle.CmdRun:  b.run,
+		merle.CmdInit:  b.init,
+		merle.CmdRun:   b.run,
+		merle.GetState: b.getState,
 	}
 }
 
@@ -50,5 +79,7 @@ func (b *blinky) Assets() *merle.ThingAssets {
 
 func main() {
 	thing := merle.NewThing(&blinky{})
+	thing.Cfg.Model = "blinky"
+	thing.Cfg.MotherHost = motherHost
 	thing.Run()
 }
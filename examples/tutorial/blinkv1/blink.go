@@ -7,25 +7,28 @@ import (
 	"time"
 
 	"github.com/merliot/merle"
-	"gobot.io/x/gobot/drivers/gpio"
-	"gobot.io/x/gobot/platforms/raspi"
+	"github.com/merliot/merle/hal"
 )
 
 type blink struct {
-	adaptor *raspi.Adaptor
-	led     *gpio.LedDriver
+	led hal.DigitalOut
+	on  bool
 }
 
 func (b *blink) init(p *merle.Packet) {
-	b.adaptor = raspi.NewAdaptor()
-	b.adaptor.Connect()
-	b.led = gpio.NewLedDriver(b.adaptor, "11")
-	b.led.Start()
+	// LED on header pin 11 (GPIO17)
+	led, err := hal.NewLinux().DigitalOut(17)
+	if err != nil {
+		log.Fatalln("Opening LED failed:", err)
+	}
+	b.led = led
+	b.led.Set(b.on)
 }
 
 func (b *blink) run(p *merle.Packet) {
 	for {
-		b.led.Toggle()
+		b.on = !b.on
+		b.led.Set(b.on)
 		time.Sleep(time.Second)
 	}
 }
@@ -8,31 +8,31 @@ import (
 	"time"
 
 	"github.com/merliot/merle"
-	"gobot.io/x/gobot/drivers/gpio"
-	"gobot.io/x/gobot/platforms/raspi"
+	"github.com/merliot/merle/hal"
 )
 
 type blink struct {
 	sync.Mutex
-	adaptor *raspi.Adaptor
-	led     *gpio.LedDriver
-	Msg     string
-	State   bool
+	led   hal.DigitalOut
+	Msg   string
+	State bool
 }
 
 func (b *blink) init(p *merle.Packet) {
-	b.adaptor = raspi.NewAdaptor()
-	b.adaptor.Connect()
-	b.led = gpio.NewLedDriver(b.adaptor, "11")
-	b.led.Start()
-	b.State = b.led.State()
+	// LED on header pin 11 (GPIO17)
+	led, err := hal.NewLinux().DigitalOut(17)
+	if err != nil {
+		log.Fatalln("Opening LED failed:", err)
+	}
+	b.led = led
+	b.led.Set(b.State)
 }
 
 func (b *blink) run(p *merle.Packet) {
 	for {
-		b.led.Toggle()
 		b.Lock()
-		b.State = b.led.State()
+		b.State = !b.State
+		b.led.Set(b.State)
 		b.Msg = "Update"
 		p.Marshal(b)
 		b.Unlock()
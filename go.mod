@@ -1,15 +1,25 @@
 module github.com/merliot/merle
 
-go 1.15
+go 1.18
 
 require (
+	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/go-daq/canbus v0.0.0-20161123191156-079be98fdbd7
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.5.0
 	github.com/msteinert/pam v1.0.0
 	github.com/pkg/errors v0.9.1
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
-	gobot.io/x/gobot v1.16.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 	tinygo.org/x/drivers v0.21.0
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
+	golang.org/x/text v0.3.6 // indirect
+)
@@ -0,0 +1,134 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Package hal is a hardware abstraction layer for Thingers.  A Thinger
+// written against hal's device interfaces, rather than against a particular
+// board's drivers, runs on any Linux box with the Linux backend, and runs
+// (and tests) anywhere with the Mock backend:
+//
+//	type relay struct {
+//		backend hal.Backend
+//		out     hal.DigitalOut
+//	}
+//
+//	func (r *relay) init(p *merle.Packet) {
+//		r.out, _ = r.backend.DigitalOut(6) // GPIO 6
+//	}
+//
+// Pins are numbered by GPIO number (BCM numbering on a Raspberry Pi), not by
+// header pin.
+package hal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+// DigitalOut is a digital output pin
+type DigitalOut interface {
+	// Set the pin high (on is true) or low
+	Set(on bool) error
+}
+
+// DigitalIn is a digital input pin
+type DigitalIn interface {
+	// Get the pin level; true is high
+	Get() (bool, error)
+}
+
+// I2C is a device on an I2C bus, accessed by register
+type I2C interface {
+	// Read len(buf) bytes, starting at register reg
+	ReadReg(reg byte, buf []byte) error
+	// Write data, starting at register reg
+	WriteReg(reg byte, data []byte) error
+	// Close the device
+	Close() error
+}
+
+// Serial is a line-oriented serial device, such as a modem taking AT
+// commands or a GPS receiver sending NMEA sentences
+type Serial interface {
+	// Write data to the device, as is
+	Write(data []byte) (int, error)
+	// ReadLine returns the next line from the device, without the line
+	// ending ("\n" or "\r\n").  ReadLine returns ErrTimeout if no line
+	// arrives within the backend's read timeout.
+	ReadLine() (string, error)
+	// Flush discards any input not yet read
+	Flush() error
+	// Close the device
+	Close() error
+}
+
+// A Backend opens devices
+type Backend interface {
+	// DigitalOut opens GPIO pin as an output
+	DigitalOut(pin int) (DigitalOut, error)
+	// DigitalIn opens GPIO pin as an input
+	DigitalIn(pin int) (DigitalIn, error)
+	// I2C opens the device at address addr on I2C bus
+	I2C(bus int, addr uint16) (I2C, error)
+	// Serial opens serial device name (e.g. "/dev/ttyUSB0") at baud
+	Serial(name string, baud int) (Serial, error)
+}
+
+// ErrTimeout is returned by Serial ReadLine when no line arrives in time
+var ErrTimeout = errors.New("Timed out")
+
+// lineSerial reads lines from a port which returns zero bytes when a read
+// times out
+type lineSerial struct {
+	port    io.ReadWriteCloser
+	pending []byte
+	buf     [256]byte
+}
+
+func newLineSerial(port io.ReadWriteCloser) *lineSerial {
+	return &lineSerial{port: port}
+}
+
+func (s *lineSerial) Write(data []byte) (int, error) {
+	return s.port.Write(data)
+}
+
+func (s *lineSerial) ReadLine() (string, error) {
+	for {
+		if i := bytes.IndexByte(s.pending, '\n'); i >= 0 {
+			line := string(s.pending[:i])
+			s.pending = s.pending[i+1:]
+			return strings.TrimSuffix(line, "\r"), nil
+		}
+
+		n, err := s.port.Read(s.buf[:])
+		if n == 0 {
+			if err != nil && err != io.EOF {
+				return "", err
+			}
+			if len(s.pending) > 0 {
+				// Timed out mid-line; return what there is
+				line := string(s.pending)
+				s.pending = nil
+				return strings.TrimSuffix(line, "\r"), nil
+			}
+			return "", ErrTimeout
+		}
+
+		s.pending = append(s.pending, s.buf[:n]...)
+	}
+}
+
+func (s *lineSerial) Flush() error {
+	s.pending = nil
+	if f, ok := s.port.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (s *lineSerial) Close() error {
+	return s.port.Close()
+}
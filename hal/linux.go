@@ -0,0 +1,188 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package hal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// Linux is the backend for Linux boards.  GPIO pins are accessed through
+// sysfs, I2C devices through i2c-dev, and serial devices through the tty
+// driver, so Linux works on any Linux box with those drivers, not just on a
+// Raspberry Pi.
+type Linux struct {
+	// sysfs GPIO directory.  The default is "/sys/class/gpio".
+	GpioDir string
+	// Directory holding I2C bus devices (i2c-N).  The default is "/dev".
+	DevDir string
+	// How long a Serial device's ReadLine waits for a line.  The default
+	// is half a second.
+	SerialTimeout time.Duration
+}
+
+// NewLinux returns a Linux backend with default settings
+func NewLinux() *Linux {
+	return &Linux{
+		GpioDir:       "/sys/class/gpio",
+		DevDir:        "/dev",
+		SerialTimeout: time.Second / 2,
+	}
+}
+
+// How long to wait for a newly exported pin's files to become writable
+const exportWait = time.Second
+
+// Export pin and set its direction ("in" or "out"), returning the path to
+// the pin's value file
+func (l *Linux) gpio(pin int, direction string) (string, error) {
+	dir := filepath.Join(l.GpioDir, "gpio"+strconv.Itoa(pin))
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		export := filepath.Join(l.GpioDir, "export")
+		if err := writeFile(export, strconv.Itoa(pin)); err != nil {
+			return "", fmt.Errorf("Exporting GPIO %d: %w", pin, err)
+		}
+	}
+
+	// Right after export, udev may not yet have made the pin's files
+	// writable, so retry for a bit
+	var err error
+	for start := time.Now(); time.Since(start) < exportWait; {
+		err = writeFile(filepath.Join(dir, "direction"), direction)
+		if err == nil {
+			return filepath.Join(dir, "value"), nil
+		}
+		time.Sleep(exportWait / 10)
+	}
+
+	return "", fmt.Errorf("Setting GPIO %d direction: %w", pin, err)
+}
+
+func writeFile(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type sysfsPin struct {
+	value string
+}
+
+func (p *sysfsPin) Set(on bool) error {
+	value := "0"
+	if on {
+		value = "1"
+	}
+	return writeFile(p.value, value)
+}
+
+func (p *sysfsPin) Get() (bool, error) {
+	value, err := os.ReadFile(p.value)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(value)) == "1", nil
+}
+
+// DigitalOut opens GPIO pin as an output
+func (l *Linux) DigitalOut(pin int) (DigitalOut, error) {
+	value, err := l.gpio(pin, "out")
+	if err != nil {
+		return nil, err
+	}
+	return &sysfsPin{value: value}, nil
+}
+
+// DigitalIn opens GPIO pin as an input
+func (l *Linux) DigitalIn(pin int) (DigitalIn, error) {
+	value, err := l.gpio(pin, "in")
+	if err != nil {
+		return nil, err
+	}
+	return &sysfsPin{value: value}, nil
+}
+
+// i2c-dev ioctl to set the device address
+const i2cSlave = 0x0703
+
+type i2cDev struct {
+	sync.Mutex
+	f *os.File
+}
+
+// I2C opens the device at address addr on I2C bus (/dev/i2c-<bus>)
+func (l *Linux) I2C(bus int, addr uint16) (I2C, error) {
+	path := filepath.Join(l.DevDir, "i2c-"+strconv.Itoa(bus))
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Opening I2C bus %d: %w", bus, err)
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), i2cSlave,
+		uintptr(addr))
+	if errno != 0 {
+		f.Close()
+		return nil, fmt.Errorf("Setting I2C address 0x%02x: %w", addr,
+			errno)
+	}
+
+	return &i2cDev{f: f}, nil
+}
+
+func (d *i2cDev) ReadReg(reg byte, buf []byte) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, err := d.f.Write([]byte{reg}); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(d.f, buf)
+	return err
+}
+
+func (d *i2cDev) WriteReg(reg byte, data []byte) error {
+	d.Lock()
+	defer d.Unlock()
+
+	_, err := d.f.Write(append([]byte{reg}, data...))
+	return err
+}
+
+func (d *i2cDev) Close() error {
+	return d.f.Close()
+}
+
+// Serial opens serial device name (e.g. "/dev/ttyUSB0") at baud
+func (l *Linux) Serial(name string, baud int) (Serial, error) {
+	cfg := &serial.Config{Name: name, Baud: baud,
+		ReadTimeout: l.SerialTimeout}
+
+	port, err := serial.OpenPort(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Opening serial %s: %w", name, err)
+	}
+
+	return newLineSerial(port), nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package hal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinuxGpio(t *testing.T) {
+	l := NewLinux()
+	l.GpioDir = t.TempDir()
+
+	// A sysfs GPIO directory with pin 6 already exported
+	pin := filepath.Join(l.GpioDir, "gpio6")
+	os.Mkdir(pin, 0700)
+	os.WriteFile(filepath.Join(pin, "direction"), []byte("in"), 0600)
+	os.WriteFile(filepath.Join(pin, "value"), []byte("0\n"), 0600)
+
+	out, err := l.DigitalOut(6)
+	if err != nil {
+		t.Fatalf("DigitalOut failed: %s", err)
+	}
+
+	dir, _ := os.ReadFile(filepath.Join(pin, "direction"))
+	if string(dir) != "out" {
+		t.Errorf("Direction %q, want out", dir)
+	}
+
+	out.Set(true)
+	value, _ := os.ReadFile(filepath.Join(pin, "value"))
+	if string(value) != "1" {
+		t.Errorf("Value %q, want 1", value)
+	}
+
+	in, _ := l.DigitalIn(6)
+	if level, err := in.Get(); !level || err != nil {
+		t.Errorf("Get() = %t, %v; want true, nil", level, err)
+	}
+}
+
+func TestLinuxGpioExport(t *testing.T) {
+	l := NewLinux()
+	l.GpioDir = t.TempDir()
+	os.WriteFile(filepath.Join(l.GpioDir, "export"), nil, 0600)
+
+	// Nothing makes gpio13 appear, so the export never completes
+	if _, err := l.DigitalOut(13); err == nil {
+		t.Fatalf("DigitalOut on missing pin should fail")
+	}
+
+	export, _ := os.ReadFile(filepath.Join(l.GpioDir, "export"))
+	if string(export) != "13" {
+		t.Errorf("Exported %q, want 13", export)
+	}
+}
@@ -0,0 +1,364 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package hal
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Mock is a scriptable backend, with no hardware behind it.  Devices are
+// created on first open, and the test (or demo) scripts them through Pin(),
+// Device() and Port(): driving input pins, checking output pins, filling I2C
+// registers, and replying to serial commands.
+//
+//	mock := hal.NewMock()
+//	thing := merle.NewThing(relays.NewRelaysOn(mock))
+//	...
+//	if !mock.Pin(6).Level() {
+//		t.Errorf("Relay 0 should be on")
+//	}
+type Mock struct {
+	// How long a Serial device's ReadLine waits for a line.  The default
+	// is zero: ReadLine returns ErrTimeout at once if no line is queued.
+	// Set SerialTimeout before the first Port() or Serial().
+	SerialTimeout time.Duration
+	lock          sync.Mutex
+	pins          map[int]*MockPin
+	devices       map[mockAddr]*MockI2C
+	ports         map[string]*MockSerial
+}
+
+type mockAddr struct {
+	bus  int
+	addr uint16
+}
+
+// NewMock returns a Mock backend, with no devices
+func NewMock() *Mock {
+	return &Mock{
+		pins:    make(map[int]*MockPin),
+		devices: make(map[mockAddr]*MockI2C),
+		ports:   make(map[string]*MockSerial),
+	}
+}
+
+// Pin returns GPIO pin, for scripting
+func (m *Mock) Pin(pin int) *MockPin {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p, ok := m.pins[pin]
+	if !ok {
+		p = &MockPin{}
+		m.pins[pin] = p
+	}
+	return p
+}
+
+// Device returns the device at address addr on I2C bus, for scripting
+func (m *Mock) Device(bus int, addr uint16) *MockI2C {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := mockAddr{bus, addr}
+	d, ok := m.devices[key]
+	if !ok {
+		d = &MockI2C{regs: make(map[byte]byte)}
+		m.devices[key] = d
+	}
+	return d
+}
+
+// Port returns serial device name, for scripting
+func (m *Mock) Port(name string) *MockSerial {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, ok := m.ports[name]
+	if !ok {
+		s = &MockSerial{
+			timeout: m.SerialTimeout,
+			replies: make(map[string][]string),
+			notify:  make(chan bool, 1),
+		}
+		m.ports[name] = s
+	}
+	return s
+}
+
+// DigitalOut opens GPIO pin as an output
+func (m *Mock) DigitalOut(pin int) (DigitalOut, error) {
+	return m.Pin(pin), nil
+}
+
+// DigitalIn opens GPIO pin as an input
+func (m *Mock) DigitalIn(pin int) (DigitalIn, error) {
+	return m.Pin(pin), nil
+}
+
+// I2C opens the device at address addr on I2C bus
+func (m *Mock) I2C(bus int, addr uint16) (I2C, error) {
+	return m.Device(bus, addr), nil
+}
+
+// Serial opens serial device name.  The baud rate is ignored.
+func (m *Mock) Serial(name string, baud int) (Serial, error) {
+	s := m.Port(name)
+	s.lock.Lock()
+	s.closed = false
+	s.lock.Unlock()
+	return s, nil
+}
+
+// MockPin is a mock GPIO pin.  The pin's level is set by the Thinger, as an
+// output, or driven by the script, as an input.
+type MockPin struct {
+	lock    sync.Mutex
+	level   bool
+	history []bool
+	err     error
+}
+
+// Set the pin level, as an output
+func (p *MockPin) Set(on bool) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	p.level = on
+	p.history = append(p.history, on)
+	return nil
+}
+
+// Get the pin level, as an input
+func (p *MockPin) Get() (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.level, p.err
+}
+
+// Drive the pin to level, as if from outside; the next Get() returns level
+func (p *MockPin) Drive(level bool) {
+	p.lock.Lock()
+	p.level = level
+	p.lock.Unlock()
+}
+
+// Level is the pin's current level
+func (p *MockPin) Level() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.level
+}
+
+// History is every level Set(), in order
+func (p *MockPin) History() []bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return append([]bool(nil), p.history...)
+}
+
+// Fail makes Set() and Get() fail with err, until Fail(nil)
+func (p *MockPin) Fail(err error) {
+	p.lock.Lock()
+	p.err = err
+	p.lock.Unlock()
+}
+
+// MockI2C is a mock I2C device: a file of byte registers.  Reads and writes
+// auto-increment the register address, like most I2C devices.
+type MockI2C struct {
+	lock    sync.Mutex
+	regs    map[byte]byte
+	onWrite func(d *MockI2C, reg byte, data []byte)
+	err     error
+}
+
+// SetRegs sets registers, starting at register reg, to data
+func (d *MockI2C) SetRegs(reg byte, data ...byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for i, b := range data {
+		d.regs[reg+byte(i)] = b
+	}
+}
+
+// Regs returns n registers, starting at register reg
+func (d *MockI2C) Regs(reg byte, n int) []byte {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = d.regs[reg+byte(i)]
+	}
+	return data
+}
+
+// OnWrite calls f after each WriteReg() by the Thinger, for example to
+// simulate a measurement started by writing a control register.  f may call
+// SetRegs().
+func (d *MockI2C) OnWrite(f func(d *MockI2C, reg byte, data []byte)) {
+	d.lock.Lock()
+	d.onWrite = f
+	d.lock.Unlock()
+}
+
+// Fail makes ReadReg() and WriteReg() fail with err, until Fail(nil)
+func (d *MockI2C) Fail(err error) {
+	d.lock.Lock()
+	d.err = err
+	d.lock.Unlock()
+}
+
+// ReadReg reads len(buf) registers, starting at register reg
+func (d *MockI2C) ReadReg(reg byte, buf []byte) error {
+	d.lock.Lock()
+	err := d.err
+	d.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	copy(buf, d.Regs(reg, len(buf)))
+	return nil
+}
+
+// WriteReg writes registers, starting at register reg
+func (d *MockI2C) WriteReg(reg byte, data []byte) error {
+	d.lock.Lock()
+	err, onWrite := d.err, d.onWrite
+	d.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	d.SetRegs(reg, data...)
+	if onWrite != nil {
+		onWrite(d, reg, data)
+	}
+	return nil
+}
+
+// Close the device
+func (d *MockI2C) Close() error {
+	return nil
+}
+
+// MockSerial is a mock serial device.  Lines are queued for the Thinger's
+// ReadLine() by the script, either unprompted with Feed(), or in reply to
+// the Thinger's writes with Reply().
+type MockSerial struct {
+	lock    sync.Mutex
+	timeout time.Duration
+	replies map[string][]string
+	lines   []string
+	written []string
+	notify  chan bool
+	closed  bool
+}
+
+// Reply queues lines each time the Thinger writes exactly cmd
+func (s *MockSerial) Reply(cmd string, lines ...string) {
+	s.lock.Lock()
+	s.replies[cmd] = lines
+	s.lock.Unlock()
+}
+
+// Feed queues lines now
+func (s *MockSerial) Feed(lines ...string) {
+	s.lock.Lock()
+	s.lines = append(s.lines, lines...)
+	s.lock.Unlock()
+
+	select {
+	case s.notify <- true:
+	default:
+	}
+}
+
+// Written is everything the Thinger wrote, one entry per Write()
+func (s *MockSerial) Written() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string(nil), s.written...)
+}
+
+// Write data to the device
+func (s *MockSerial) Write(data []byte) (int, error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return 0, os.ErrClosed
+	}
+	s.written = append(s.written, string(data))
+	lines, ok := s.replies[string(data)]
+	s.lock.Unlock()
+
+	if ok {
+		s.Feed(lines...)
+	}
+
+	return len(data), nil
+}
+
+// ReadLine returns the next queued line, waiting up to the Mock's
+// SerialTimeout for one
+func (s *MockSerial) ReadLine() (string, error) {
+	var timeout <-chan time.Time
+
+	for {
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			return "", os.ErrClosed
+		}
+		if len(s.lines) > 0 {
+			line := s.lines[0]
+			s.lines = s.lines[1:]
+			s.lock.Unlock()
+			return line, nil
+		}
+		s.lock.Unlock()
+
+		if s.timeout == 0 {
+			return "", ErrTimeout
+		}
+		if timeout == nil {
+			timeout = time.After(s.timeout)
+		}
+
+		select {
+		case <-s.notify:
+		case <-timeout:
+			return "", ErrTimeout
+		}
+	}
+}
+
+// Flush discards queued lines
+func (s *MockSerial) Flush() error {
+	s.lock.Lock()
+	s.lines = nil
+	s.lock.Unlock()
+	return nil
+}
+
+// Close the device.  Serial() on the Mock reopens it.
+func (s *MockSerial) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package hal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMockPin(t *testing.T) {
+	var b Backend = NewMock()
+	m := b.(*Mock)
+
+	out, _ := b.DigitalOut(6)
+	out.Set(true)
+	out.Set(false)
+	out.Set(true)
+
+	if !m.Pin(6).Level() {
+		t.Errorf("Pin 6 low, want high")
+	}
+	if got := m.Pin(6).History(); !reflect.DeepEqual(got, []bool{true, false, true}) {
+		t.Errorf("Pin 6 history %v", got)
+	}
+
+	in, _ := b.DigitalIn(17)
+	m.Pin(17).Drive(true)
+	if level, err := in.Get(); !level || err != nil {
+		t.Errorf("Pin 17 Get() = %t, %v; want true, nil", level, err)
+	}
+
+	fail := errors.New("Stuck")
+	m.Pin(6).Fail(fail)
+	if err := out.Set(false); err != fail {
+		t.Errorf("Set() = %v, want %v", err, fail)
+	}
+}
+
+func TestMockI2C(t *testing.T) {
+	m := NewMock()
+
+	// Writing 0x2e to control register 0xf4 starts a measurement
+	m.Device(1, 0x77).OnWrite(func(d *MockI2C, reg byte, data []byte) {
+		if reg == 0xf4 && data[0] == 0x2e {
+			d.SetRegs(0xf6, 0x12, 0x34)
+		}
+	})
+
+	dev, _ := m.I2C(1, 0x77)
+	buf := make([]byte, 2)
+
+	dev.ReadReg(0xf6, buf)
+	if !bytes.Equal(buf, []byte{0, 0}) {
+		t.Errorf("Read %x before measurement, want 0000", buf)
+	}
+
+	dev.WriteReg(0xf4, []byte{0x2e})
+	dev.ReadReg(0xf6, buf)
+	if !bytes.Equal(buf, []byte{0x12, 0x34}) {
+		t.Errorf("Read %x after measurement, want 1234", buf)
+	}
+}
+
+func TestMockSerial(t *testing.T) {
+	m := NewMock()
+	m.Port("/dev/ttyUSB0").Reply("AT\r", "AT", "OK")
+
+	s, _ := m.Serial("/dev/ttyUSB0", 115200)
+
+	s.Write([]byte("AT\r"))
+	for _, want := range []string{"AT", "OK"} {
+		if line, err := s.ReadLine(); line != want || err != nil {
+			t.Errorf("ReadLine() = %q, %v; want %q", line, err, want)
+		}
+	}
+	if _, err := s.ReadLine(); err != ErrTimeout {
+		t.Errorf("ReadLine() = %v, want ErrTimeout", err)
+	}
+
+	if got := m.Port("/dev/ttyUSB0").Written(); !reflect.DeepEqual(got, []string{"AT\r"}) {
+		t.Errorf("Written %q", got)
+	}
+}
+
+func TestMockSerialTimeout(t *testing.T) {
+	m := NewMock()
+	m.SerialTimeout = time.Second
+
+	s, _ := m.Serial("/dev/ttyUSB0", 9600)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		m.Port("/dev/ttyUSB0").Feed("$GPGGA,1")
+	}()
+
+	if line, err := s.ReadLine(); line != "$GPGGA,1" || err != nil {
+		t.Errorf("ReadLine() = %q, %v; want $GPGGA,1", line, err)
+	}
+}
+
+// fakePort returns its reads one at a time, then times out (0, io.EOF)
+type fakePort struct {
+	reads []string
+}
+
+func (p *fakePort) Read(buf []byte) (int, error) {
+	if len(p.reads) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(buf, p.reads[0])
+	p.reads = p.reads[1:]
+	return n, nil
+}
+
+func (p *fakePort) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (p *fakePort) Close() error {
+	return nil
+}
+
+func TestLineSerial(t *testing.T) {
+	s := newLineSerial(&fakePort{reads: []string{
+		"AT\r\r\n$GPS", "ACP: 1,2\r\n\r\nOK\r\n", "partial"}})
+
+	want := []string{"AT\r", "$GPSACP: 1,2", "", "OK", "partial"}
+	for _, w := range want {
+		if line, err := s.ReadLine(); line != w || err != nil {
+			t.Errorf("ReadLine() = %q, %v; want %q", line, err, w)
+		}
+	}
+	if _, err := s.ReadLine(); err != ErrTimeout {
+		t.Errorf("ReadLine() = %v, want ErrTimeout", err)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+// Handle adapts a typed message handler into a subscriber handler.  The
+// Packet message is decoded into a new T and passed to the handler, so the
+// handler doesn't need to Unmarshal the Packet itself.  The message type is
+// declared once, by the handler's signature:
+//
+//	type MsgSetPoint struct {
+//		Msg string
+//		Val int
+//	}
+//
+//	func (t *thing) setPoint(p *merle.Packet, msg *MsgSetPoint) {
+//		t.Lock()
+//		t.SetPoint = msg.Val
+//		t.Unlock()
+//		p.Broadcast()
+//	}
+//
+//	func (t *thing) Subscribers() merle.Subscribers {
+//		return merle.Subscribers{
+//			...
+//			"SetPoint": merle.Handle(t.setPoint),
+//		}
+//	}
+//
+// A malformed message, one which can't be decoded into T, is logged and
+// dropped, and the handler isn't called.  If the malformed message was a
+// request (see Packet.Request()), a ReplyError is sent back to the requester.
+//
+// If the handler is nil, the Packet will be dropped silently.
+func Handle[T any](handler func(*Packet, *T)) func(*Packet) {
+	if handler == nil {
+		return nil
+	}
+	return func(p *Packet) {
+		var msg T
+		if err := p.Unmarshal(&msg); err != nil {
+			p.bus.thing.log.printf("Dropping malformed message [%s]: %s: %.80s",
+				p.Src(), err, p.String())
+			if p.reqId != "" {
+				resp := MsgError{Msg: ReplyError, Error: err.Error()}
+				p.Marshal(&resp).Reply()
+			}
+			return
+		}
+		handler(p, &msg)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"testing"
+	"time"
+)
+
+type msgSet struct {
+	Msg string
+	Val int
+}
+
+type setter struct {
+	vals []int
+}
+
+func (s *setter) set(p *Packet, msg *msgSet) {
+	s.vals = append(s.vals, msg.Val)
+}
+
+func (s *setter) Subscribers() Subscribers {
+	return Subscribers{
+		"Set": Handle(s.set),
+	}
+}
+
+func (s *setter) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+func TestHandle(t *testing.T) {
+	var child setter
+
+	mother, thing := wireThings(t, &sparse{}, &child)
+
+	thing.Inject(&msgSet{Msg: "Set", Val: 42})
+	thing.Inject(&struct {
+		Msg string
+		Val string
+	}{Msg: "Set", Val: "forty-two"})
+
+	if len(child.vals) != 1 || child.vals[0] != 42 {
+		t.Errorf("Got values %v, want [42]", child.vals)
+	}
+
+	bad := map[string]interface{}{"Msg": "Set", "Val": true}
+	rsp, err := mother.Request("child", &bad, time.Second)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+
+	var msg MsgError
+	rsp.Unmarshal(&msg)
+	if msg.Msg != ReplyError || msg.Error == "" {
+		t.Errorf("Malformed request got %s, want %s", rsp, ReplyError)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net/http"
+)
+
+// JS helper served at /merle.js.  Include it in the Thing's HTML template:
+//
+//	<script src="/merle.js"></script>
+//
+// and pass each message received on the websocket through merle.update(),
+// which turns a StatePatch into the full, patched ReplyState:
+//
+//	conn.onmessage = function(evt) {
+//		msg = merle.update(JSON.parse(evt.data))
+//		switch(msg.Msg) {
+//		case "_ReplyState":
+//			refresh(msg)
+//			break
+//		...
+//		}
+//	}
+const merleJs = `// Merle JS helper
+var merle = (function() {
+
+	var state = null
+
+	function unescape(token) {
+		return token.replace(/~1/g, "/").replace(/~0/g, "~")
+	}
+
+	// Apply JSON Patch (RFC 6902) "add", "remove" and "replace"
+	// operations to doc, returning the patched doc
+	function applyPatch(doc, patch) {
+		for (var n = 0; n < patch.length; n++) {
+			var op = patch[n]
+			if (op.path === "") {
+				doc = (op.op === "remove") ? null : op.value
+				continue
+			}
+			var tokens = op.path.substring(1).split("/").map(unescape)
+			var key = tokens.pop()
+			var parent = doc
+			for (var i = 0; i < tokens.length; i++) {
+				parent = parent[tokens[i]]
+			}
+			if (Array.isArray(parent)) {
+				var idx = (key === "-") ? parent.length : parseInt(key)
+				switch (op.op) {
+				case "add":
+					parent.splice(idx, 0, op.value)
+					break
+				case "remove":
+					parent.splice(idx, 1)
+					break
+				case "replace":
+					parent[idx] = op.value
+					break
+				}
+			} else {
+				if (op.op === "remove") {
+					delete parent[key]
+				} else {
+					parent[key] = op.value
+				}
+			}
+		}
+		return doc
+	}
+
+	// Track Thing's state.  ReplyState messages are saved, and
+	// StatePatch messages are applied to the saved state and returned as
+	// a ReplyState message.  Other messages are returned as-is.
+	function update(msg) {
+		switch (msg.Msg) {
+		case "_ReplyState":
+			state = JSON.parse(JSON.stringify(msg))
+			break
+		case "_StatePatch":
+			if (state === null) {
+				return msg
+			}
+			state = applyPatch(state, msg.Patch)
+			state.Msg = "_ReplyState"
+			return JSON.parse(JSON.stringify(state))
+		}
+		return msg
+	}
+
+	return {
+		applyPatch: applyPatch,
+		update: update,
+	}
+})()
+`
+
+func (t *Thing) js(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript")
+	w.Write([]byte(merleJs))
+}
@@ -0,0 +1,207 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Path on Mother's private HTTP server, or public HTTPS server, for
+	// links
+	linkPath = "/attach"
+	// Wait between attempts to (re)dial Mother
+	linkRetry = 5 * time.Second
+	// Thing pings Mother on the link this often.  Either end drops the
+	// link once linkKeepaliveMax keepalives in a row go unanswered, so a
+	// half-open link (Thing lost power, NAT dropped the connection) is
+	// noticed, like the tunnel's keepalives.
+	linkKeepalive    = 15 * time.Second
+	linkKeepaliveMax = 3
+)
+
+// Dial a connection to addr (host:port)
+type linkDialer func(addr string) (io.ReadWriteCloser, error)
+
+// A link is a Thing's outbound websocket to its Mother.  Rather than Mother
+// reaching Thing through a tunnel, Thing dials Mother's private HTTP server
+// and Mother attaches Thing as if Thing came in on a port.  Mother sends
+// GetIdentity and GetState on the link, and from then on the link is plugged
+// into Thing's bus like any other websocket.  Messages on the link are
+// always JSON.
+//
+// A link is small enough to run on TinyGo, so microcontroller Things can be
+// children of a bridge.  Other Things link to Mother's public HTTPS server,
+// presenting a token, where SSH to Mother isn't allowed (see
+// ThingConfig.MotherTransport).
+type link struct {
+	thing *Thing
+	addr  string
+	token string
+	dial  linkDialer
+	// How often to ping mother.  The default is linkKeepalive.
+	keepalive time.Duration
+	sync.Mutex
+	ws      *wsClient
+	done    chan bool
+	stopped bool
+}
+
+func newLink(thing *Thing, addr, token string, dial linkDialer) *link {
+	return &link{
+		thing:     thing,
+		addr:      addr,
+		token:     token,
+		dial:      dial,
+		keepalive: linkKeepalive,
+		done:      make(chan bool),
+	}
+}
+
+func (l *link) connect() (*wsClient, error) {
+	conn, err := l.dial(l.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := newWsClient(conn, l.addr, linkPath, l.token)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+// Run the link, redialing mother whenever the link drops, until stop()
+func (l *link) run() {
+	for {
+		ws, err := l.connect()
+		if err != nil {
+			l.thing.log.printf("Link to mother [%s] failed: %s", l.addr, err)
+		} else {
+			l.Lock()
+			if l.stopped {
+				l.Unlock()
+				ws.close()
+				return
+			}
+			l.ws = ws
+			l.Unlock()
+
+			l.serve(ws)
+
+			l.Lock()
+			l.ws = nil
+			l.Unlock()
+		}
+
+		select {
+		case <-l.done:
+			return
+		case <-time.After(linkRetry):
+		}
+	}
+}
+
+// Plug the link into Thing's bus and put messages received from mother on the
+// bus, until the link drops
+func (l *link) serve(ws *wsClient) {
+	var name = "link:" + l.addr
+	var sock = &linkSocket{name: name, thing: l.thing, ws: ws}
+
+	l.thing.log.printf("Link opened [%s]", name)
+
+	l.thing.bus.plugin(sock)
+
+	// Mother answers pings; if mother goes quiet, the read times out
+	ws.readTimeout = l.keepalive * linkKeepaliveMax
+	done := make(chan bool)
+	go l.pings(ws, done)
+
+	for {
+		msg, err := ws.readMessage()
+		if err != nil {
+			l.thing.log.printf("Link closed [%s]", name)
+			break
+		}
+
+		// New pkt for each rcv
+		var pkt = newPacket(l.thing.bus, sock, nil)
+		pkt.msg = msg
+
+		l.thing.bus.receive(pkt)
+	}
+
+	close(done)
+	l.thing.bus.unplug(sock)
+	ws.close()
+}
+
+// Ping mother every keepalive, until done
+func (l *link) pings(ws *wsClient, done chan bool) {
+	ticker := time.NewTicker(l.keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := ws.ping(); err != nil {
+			return
+		}
+	}
+}
+
+// Stop the link; run() returns.  It's safe to call stop() more than once.
+func (l *link) stop() {
+	l.Lock()
+	defer l.Unlock()
+	if l.stopped {
+		return
+	}
+	l.stopped = true
+	close(l.done)
+	if l.ws != nil {
+		l.ws.close()
+	}
+}
+
+// linkSocket plugs a link into Thing's bus
+type linkSocket struct {
+	name  string
+	flags uint32
+	thing *Thing
+	ws    *wsClient
+}
+
+func (s *linkSocket) Send(p *Packet) error {
+	return s.ws.writeMessage(p.msg)
+}
+
+func (s *linkSocket) Close() {
+	s.ws.close()
+}
+
+func (s *linkSocket) Name() string {
+	return s.name
+}
+
+func (s *linkSocket) Flags() uint32 {
+	return s.flags
+}
+
+func (s *linkSocket) SetFlags(flags uint32) {
+	s.flags = flags
+}
+
+func (s *linkSocket) Src() string {
+	return s.thing.id
+}
@@ -0,0 +1,508 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// linked is a Thing which links to its bridge
+type linked struct {
+	State
+	Count int
+	pings chan bool
+}
+
+func (l *linked) ping(p *Packet) {
+	l.pings <- true
+}
+
+func (l *linked) Subscribers() Subscribers {
+	return Subscribers{
+		"Ping": l.ping,
+	}
+}
+
+func (l *linked) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+// linkedCopy is the bridge's copy of linked
+type linkedCopy struct {
+	Msg     string
+	Count   int
+	updates chan int
+}
+
+func (c *linkedCopy) save(p *Packet) {
+	p.Unmarshal(c)
+	c.updates <- c.Count
+}
+
+func (c *linkedCopy) Subscribers() Subscribers {
+	return Subscribers{
+		ReplyState: c.save,
+		"Update":   c.save,
+	}
+}
+
+func (c *linkedCopy) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+type linkBridge struct {
+	updates  chan int
+	statuses chan bool
+}
+
+func (b *linkBridge) status(p *Packet) {
+	var msg MsgEventStatus
+	p.Unmarshal(&msg)
+	b.statuses <- msg.Online
+}
+
+func (b *linkBridge) Subscribers() Subscribers {
+	return Subscribers{
+		EventStatus: b.status,
+	}
+}
+
+func (b *linkBridge) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+func (b *linkBridge) BridgeThingers() BridgeThingers {
+	return BridgeThingers{
+		".*:linked:.*": func() Thinger {
+			return &linkedCopy{updates: b.updates}
+		},
+	}
+}
+
+func (b *linkBridge) BridgeSubscribers() Subscribers {
+	return Subscribers{
+		"default": nil,
+	}
+}
+
+func tcpDial(addr string) (io.ReadWriteCloser, error) {
+	return net.Dial("tcp", addr)
+}
+
+func TestLink(t *testing.T) {
+	b := &linkBridge{updates: make(chan int, 10), statuses: make(chan bool, 10)}
+	bridge := NewThing(b)
+	bridge.Cfg.Id = "bridge"
+	if err := bridge.build(true); err != nil {
+		t.Fatalf("Bridge build failed: %s", err)
+	}
+
+	// Serve the bridge's private HTTP server, where links attach
+	server := httptest.NewServer(bridge.web.private.mux)
+	defer server.Close()
+
+	l := &linked{Count: 7, pings: make(chan bool, 10)}
+	child := NewThing(l)
+	child.Cfg.Id = "child01"
+	child.Cfg.Model = "linked"
+	if err := child.build(false); err != nil {
+		t.Fatalf("Child build failed: %s", err)
+	}
+
+	link := newLink(child, server.Listener.Addr().String(), "", tcpDial)
+	ran := make(chan bool)
+	go func() {
+		link.run()
+		close(ran)
+	}()
+
+	timeout := time.After(5 * time.Second)
+
+	// Bridge asks for Identity and then state, and child comes online
+	select {
+	case count := <-b.updates:
+		if count != 7 {
+			t.Errorf("Bridge got state Count %d, want 7", count)
+		}
+	case <-timeout:
+		t.Fatalf("Bridge didn't get child's state")
+	}
+	select {
+	case online := <-b.statuses:
+		if !online {
+			t.Errorf("Child attached offline")
+		}
+	case <-timeout:
+		t.Fatalf("Child didn't come online")
+	}
+
+	// Bridge to child
+	bridge.getChild("child01").Broadcast(&Msg{Msg: "Ping"})
+	select {
+	case <-l.pings:
+	case <-timeout:
+		t.Fatalf("Child didn't get bridge's ping")
+	}
+
+	// Child to bridge
+	child.Broadcast(&linked{State: State{Msg: "Update"}, Count: 8})
+	select {
+	case count := <-b.updates:
+		if count != 8 {
+			t.Errorf("Bridge got update Count %d, want 8", count)
+		}
+	case <-timeout:
+		t.Fatalf("Bridge didn't get child's update")
+	}
+
+	link.stop()
+	select {
+	case <-ran:
+	case <-timeout:
+		t.Fatalf("Link didn't stop")
+	}
+
+	select {
+	case online := <-b.statuses:
+		if online {
+			t.Errorf("Child still online after link stopped")
+		}
+	case <-timeout:
+		t.Fatalf("Child didn't go offline")
+	}
+}
+
+// blackholeConn drops everything, both ways, once blackholed, like a link
+// to a Thing which lost power
+type blackholeConn struct {
+	net.Conn
+	blackholed int32
+}
+
+func (c *blackholeConn) blackhole() {
+	atomic.StoreInt32(&c.blackholed, 1)
+}
+
+func (c *blackholeConn) isBlackholed() bool {
+	return atomic.LoadInt32(&c.blackholed) != 0
+}
+
+func (c *blackholeConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		if err != nil || !c.isBlackholed() {
+			return n, err
+		}
+	}
+}
+
+func (c *blackholeConn) Write(b []byte) (int, error) {
+	if c.isBlackholed() {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func TestLinkKeepalive(t *testing.T) {
+	b := &linkBridge{updates: make(chan int, 10), statuses: make(chan bool, 10)}
+	bridge := NewThing(b)
+	bridge.Cfg.Id = "bridge"
+	bridge.Cfg.LoggingEnabled = false
+	if err := bridge.build(true); err != nil {
+		t.Fatalf("Bridge build failed: %s", err)
+	}
+	bridge.web.linkKeepalive = 50 * time.Millisecond
+
+	server := httptest.NewServer(bridge.web.private.mux)
+	defer server.Close()
+
+	l := &linked{Count: 7, pings: make(chan bool, 10)}
+	child := NewThing(l)
+	child.Cfg.Id = "child01"
+	child.Cfg.Model = "linked"
+	child.Cfg.LoggingEnabled = false
+	if err := child.build(false); err != nil {
+		t.Fatalf("Child build failed: %s", err)
+	}
+
+	conns := make(chan *blackholeConn, 1)
+	dial := func(addr string) (io.ReadWriteCloser, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		c := &blackholeConn{Conn: conn}
+		conns <- c
+		return c, nil
+	}
+
+	link := newLink(child, server.Listener.Addr().String(), "", dial)
+	link.keepalive = 50 * time.Millisecond
+	go link.run()
+	defer link.stop()
+
+	conn := <-conns
+
+	select {
+	case online := <-b.statuses:
+		if !online {
+			t.Fatalf("Child attached offline")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Child didn't come online")
+	}
+
+	// An idle link stays up on keepalives alone
+	select {
+	case <-b.statuses:
+		t.Fatalf("Idle child went offline")
+	case <-time.After(10 * link.keepalive):
+	}
+
+	conn.blackhole()
+
+	// Both ends give up on the link: bridge takes child offline...
+	select {
+	case online := <-b.statuses:
+		if online {
+			t.Errorf("Child still online after link went dead")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Bridge didn't notice dead link")
+	}
+
+	// ...and child stops serving the link
+	for i := 0; ; i++ {
+		link.Lock()
+		ws := link.ws
+		link.Unlock()
+		if ws == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Child didn't notice dead link")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestLinkNoBridge(t *testing.T) {
+	thing := NewThing(&empty{})
+	thing.Cfg.Id = testId
+	if err := thing.build(true); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+
+	// Not a bridge, so nowhere to attach
+	server := httptest.NewServer(thing.web.private.mux)
+	defer server.Close()
+
+	conn, err := tcpDial(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err := newWsClient(conn, "localhost", linkPath, ""); err == nil {
+		t.Errorf("Link attached to a Thing which isn't a bridge")
+	}
+}
+
+func TestLinkPrivateToken(t *testing.T) {
+	bridge := NewThing(&linkBridge{})
+	bridge.Cfg.Id = "bridge"
+	bridge.Cfg.LoggingEnabled = false
+	bridge.Cfg.AttachToken = "secret"
+	if err := bridge.build(true); err != nil {
+		t.Fatalf("Bridge build failed: %s", err)
+	}
+
+	server := httptest.NewServer(bridge.web.private.mux)
+	defer server.Close()
+
+	for _, token := range []string{"", "bogus", "secret"} {
+		conn, err := tcpDial(server.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		_, err = newWsClient(conn, "localhost", linkPath, token)
+		conn.Close()
+		if got, want := err == nil, token == "secret"; got != want {
+			t.Errorf("Token %q attached %t, want %t", token, got, want)
+		}
+	}
+}
+
+// Serve mother's public HTTPS server.  Returns the server's port, and a file
+// with the server's certificate, to verify the server with.
+func wssServer(t *testing.T, mother *Thing) (uint, string) {
+	server := httptest.NewTLSServer(mother.web.public.mux)
+	t.Cleanup(server.Close)
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: server.Certificate().Raw})
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(file, cert, 0600); err != nil {
+		t.Fatalf("Writing certificate failed: %s", err)
+	}
+
+	return uint(server.Listener.Addr().(*net.TCPAddr).Port), file
+}
+
+// Child dialing home to mother over wss
+func wssChild(t *testing.T, l *linked, port uint, rootCAs, token string) *Thing {
+	child := NewThing(l)
+	child.Cfg.Id = "child01"
+	child.Cfg.Model = "linked"
+	child.Cfg.LoggingEnabled = false
+	child.Cfg.MotherHost = "127.0.0.1"
+	child.Cfg.MotherTransport = "wss"
+	child.Cfg.MotherPortWSS = port
+	child.Cfg.MotherRootCAs = rootCAs
+	child.Cfg.MotherToken = token
+	if err := child.build(true); err != nil {
+		t.Fatalf("Child build failed: %s", err)
+	}
+	return child
+}
+
+func TestLinkWSS(t *testing.T) {
+	b := &linkBridge{updates: make(chan int, 10), statuses: make(chan bool, 10)}
+	bridge := NewThing(b)
+	bridge.Cfg.Id = "bridge"
+	bridge.Cfg.LoggingEnabled = false
+	bridge.Cfg.AttachToken = "secret"
+	if err := bridge.build(true); err != nil {
+		t.Fatalf("Bridge build failed: %s", err)
+	}
+
+	port, rootCAs := wssServer(t, bridge)
+
+	l := &linked{Count: 7, pings: make(chan bool, 10)}
+	child := wssChild(t, l, port, rootCAs, "secret")
+	child.tunnel.start()
+
+	timeout := time.After(5 * time.Second)
+
+	select {
+	case count := <-b.updates:
+		if count != 7 {
+			t.Errorf("Bridge got state Count %d, want 7", count)
+		}
+	case <-timeout:
+		t.Fatalf("Bridge didn't get child's state")
+	}
+	select {
+	case online := <-b.statuses:
+		if !online {
+			t.Errorf("Child attached offline")
+		}
+	case <-timeout:
+		t.Fatalf("Child didn't come online")
+	}
+
+	child.tunnel.stop()
+
+	select {
+	case online := <-b.statuses:
+		if online {
+			t.Errorf("Child still online after tunnel stopped")
+		}
+	case <-timeout:
+		t.Fatalf("Child didn't go offline")
+	}
+}
+
+func TestLinkWSSUnauthorized(t *testing.T) {
+	bridge := NewThing(&linkBridge{})
+	bridge.Cfg.Id = "bridge"
+	bridge.Cfg.LoggingEnabled = false
+	bridge.Cfg.AttachToken = "secret"
+	if err := bridge.build(true); err != nil {
+		t.Fatalf("Bridge build failed: %s", err)
+	}
+
+	port, rootCAs := wssServer(t, bridge)
+
+	child := wssChild(t, &linked{}, port, rootCAs, "bogus")
+	link, err := child.tunnel.newLink()
+	if err != nil {
+		t.Fatalf("New link failed: %s", err)
+	}
+	if _, err := link.connect(); err == nil {
+		t.Errorf("Link attached with the wrong token")
+	}
+
+	// Mother's certificate isn't trusted
+	child = wssChild(t, &linked{}, port, "", "secret")
+	link, _ = child.tunnel.newLink()
+	if _, err := link.connect(); err == nil {
+		t.Errorf("Link attached to untrusted mother")
+	}
+
+	// TLS is required
+	server := httptest.NewServer(bridge.web.public.mux)
+	defer server.Close()
+	conn, err := tcpDial(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	if _, err := newWsClient(conn, "localhost", linkPath, "secret"); err == nil {
+		t.Errorf("Link attached without TLS")
+	}
+}
+
+func TestLinkWSSPrime(t *testing.T) {
+	c := &linkedCopy{updates: make(chan int, 10)}
+	prime := NewThing(c)
+	prime.Cfg.Model = "linked"
+	prime.Cfg.IsPrime = true
+	prime.Cfg.LoggingEnabled = false
+	prime.Cfg.AttachToken = "secret"
+	if err := prime.build(true); err != nil {
+		t.Fatalf("Prime build failed: %s", err)
+	}
+
+	port, rootCAs := wssServer(t, prime)
+
+	l := &linked{Count: 7, pings: make(chan bool, 10)}
+	child := wssChild(t, l, port, rootCAs, "secret")
+	child.tunnel.start()
+	defer child.tunnel.stop()
+
+	select {
+	case count := <-c.updates:
+		if count != 7 {
+			t.Errorf("Prime got state Count %d, want 7", count)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Prime didn't get Thing's state")
+	}
+
+	if prime.id != "child01" {
+		t.Errorf("Prime attached to %s, want child01", prime.id)
+	}
+
+	// A second attach, on the link or on the prime port, is refused
+	msg := &MsgIdentity{Id: "child01", Model: "linked"}
+	if err := prime.primeLinkAttachCb(newPort(prime, 0, nil), msg); err == nil {
+		t.Errorf("Second link attach succeeded")
+	}
+	if _, err := prime.getPrimePort("child01"); err != errPortBusy {
+		t.Errorf("getPrimePort error %v, want %v", err, errPortBusy)
+	}
+}
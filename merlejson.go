@@ -0,0 +1,747 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// A Marshaler encodes itself as a JSON object, without reflection.  On
+// TinyGo, where encoding/json isn't available, messages passed to
+// Packet.Marshal() must be Marshalers.  (On Go, Packet.Marshal() uses
+// encoding/json, so Marshalers are encoded the same as any other struct; the
+// two encodings match, as long as MarshalMerle encodes each exported field
+// under its field name.)
+//
+//	type thing struct {
+//		Msg string
+//		Led bool
+//		Temp float64
+//	}
+//
+//	func (t *thing) MarshalMerle(e *merle.Encoder) {
+//		e.String("Msg", t.Msg)
+//		e.Bool("Led", t.Led)
+//		e.Float("Temp", t.Temp)
+//	}
+type Marshaler interface {
+	MarshalMerle(e *Encoder)
+}
+
+// An Unmarshaler decodes itself from a JSON object, without reflection.  On
+// TinyGo, messages passed to Packet.Unmarshal() must be Unmarshalers.
+//
+//	func (t *thing) UnmarshalMerle(d *merle.Decoder) error {
+//		d.String("Msg", &t.Msg)
+//		d.Bool("Led", &t.Led)
+//		d.Float("Temp", &t.Temp)
+//		return d.Err()
+//	}
+//
+// As with encoding/json, members missing from the object leave their fields
+// untouched, and unknown members are ignored.
+type Unmarshaler interface {
+	UnmarshalMerle(d *Decoder) error
+}
+
+// An Encoder builds a JSON object, one member at a time, for MarshalMerle
+type Encoder struct {
+	buf []byte
+}
+
+// MarshalMerle returns the JSON encoding of m
+func MarshalMerle(m Marshaler) []byte {
+	e := &Encoder{buf: []byte{'{'}}
+	m.MarshalMerle(e)
+	return append(e.buf, '}')
+}
+
+func (e *Encoder) key(key string) {
+	if len(e.buf) > 1 {
+		e.buf = append(e.buf, ',')
+	}
+	e.buf = appendString(e.buf, key)
+	e.buf = append(e.buf, ':')
+}
+
+// String adds member key with string value v
+func (e *Encoder) String(key, v string) {
+	e.key(key)
+	e.buf = appendString(e.buf, v)
+}
+
+// Int adds member key with integer value v
+func (e *Encoder) Int(key string, v int) {
+	e.key(key)
+	e.buf = strconv.AppendInt(e.buf, int64(v), 10)
+}
+
+// Float adds member key with number value v.  NaN and infinities, which
+// JSON can't represent, are encoded as null.
+func (e *Encoder) Float(key string, v float64) {
+	e.key(key)
+	e.buf = appendFloat(e.buf, v)
+}
+
+// Bool adds member key with boolean value v
+func (e *Encoder) Bool(key string, v bool) {
+	e.key(key)
+	e.buf = strconv.AppendBool(e.buf, v)
+}
+
+// Time adds member key with time value v, as an RFC 3339 string
+func (e *Encoder) Time(key string, v time.Time) {
+	e.key(key)
+	e.buf = appendString(e.buf, v.Format(time.RFC3339Nano))
+}
+
+// Strings adds member key with array value v.  A nil v is encoded as null.
+func (e *Encoder) Strings(key string, v []string) {
+	e.key(key)
+	if v == nil {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	e.buf = append(e.buf, '[')
+	for i, s := range v {
+		if i > 0 {
+			e.buf = append(e.buf, ',')
+		}
+		e.buf = appendString(e.buf, s)
+	}
+	e.buf = append(e.buf, ']')
+}
+
+// Floats adds member key with array value v.  A nil v is encoded as null.
+func (e *Encoder) Floats(key string, v []float64) {
+	e.key(key)
+	if v == nil {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	e.buf = append(e.buf, '[')
+	for i, f := range v {
+		if i > 0 {
+			e.buf = append(e.buf, ',')
+		}
+		e.buf = appendFloat(e.buf, f)
+	}
+	e.buf = append(e.buf, ']')
+}
+
+// Bools adds member key with array value v.  A nil v is encoded as null.
+func (e *Encoder) Bools(key string, v []bool) {
+	e.key(key)
+	if v == nil {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	e.buf = append(e.buf, '[')
+	for i, b := range v {
+		if i > 0 {
+			e.buf = append(e.buf, ',')
+		}
+		e.buf = strconv.AppendBool(e.buf, b)
+	}
+	e.buf = append(e.buf, ']')
+}
+
+// Object adds member key with object value v.  A nil v is encoded as null.
+func (e *Encoder) Object(key string, v Marshaler) {
+	e.key(key)
+	if v == nil {
+		e.buf = append(e.buf, "null"...)
+		return
+	}
+	e.buf = append(e.buf, MarshalMerle(v)...)
+}
+
+// Raw adds member key with value v, which must be valid JSON
+func (e *Encoder) Raw(key string, v []byte) {
+	e.key(key)
+	e.buf = append(e.buf, v...)
+}
+
+const hex = "0123456789abcdef"
+
+// Append s as a JSON string, escaped the same as encoding/json
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				buf = append(buf, '\\', c)
+			case c == '\n':
+				buf = append(buf, '\\', 'n')
+			case c == '\r':
+				buf = append(buf, '\\', 'r')
+			case c == '\t':
+				buf = append(buf, '\\', 't')
+			case c < 0x20 || c == '<' || c == '>' || c == '&':
+				buf = append(buf, '\\', 'u', '0', '0',
+					hex[c>>4], hex[c&0xf])
+			default:
+				buf = append(buf, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			buf = append(buf, `\ufffd`...)
+		case r == '\u2028' || r == '\u2029':
+			buf = append(buf, '\\', 'u', '2', '0', '2', hex[r&0xf])
+		default:
+			buf = append(buf, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(buf, '"')
+}
+
+// Append f as a JSON number, formatted the same as encoding/json
+func appendFloat(buf []byte, f float64) []byte {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return append(buf, "null"...)
+	}
+
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+
+	start := len(buf)
+	buf = strconv.AppendFloat(buf, f, format, -1, 64)
+
+	if format == 'e' {
+		// Clean up e-09 to e-9
+		n := len(buf) - start
+		if n >= 4 && buf[len(buf)-4] == 'e' && buf[len(buf)-3] == '-' &&
+			buf[len(buf)-2] == '0' {
+			buf[len(buf)-2] = buf[len(buf)-1]
+			buf = buf[:len(buf)-1]
+		}
+	}
+
+	return buf
+}
+
+// A Decoder holds a parsed JSON object, for UnmarshalMerle to pick members
+// from.  The first error decoding a member is kept, and returned by Err().
+type Decoder struct {
+	members map[string][]byte
+	err     error
+}
+
+// UnmarshalMerle decodes the JSON object in data into u
+func UnmarshalMerle(data []byte, u Unmarshaler) error {
+	members, err := parseObject(data)
+	if err != nil {
+		return err
+	}
+	return u.UnmarshalMerle(&Decoder{members: members})
+}
+
+// Err returns the first error decoding a member, if any
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+func (d *Decoder) fail(key string, err error) {
+	if d.err == nil {
+		d.err = fmt.Errorf("Decoding %s: %w", key, err)
+	}
+}
+
+// Get member key's value, or nil if missing or null
+func (d *Decoder) value(key string) []byte {
+	v := d.members[key]
+	if string(v) == "null" {
+		return nil
+	}
+	return v
+}
+
+// Raw returns member key's value, as is, or nil if the object has no member
+// key
+func (d *Decoder) Raw(key string) []byte {
+	return d.members[key]
+}
+
+// String decodes member key into v
+func (d *Decoder) String(key string, v *string) {
+	if data := d.value(key); data != nil {
+		s, err := parseString(data)
+		if err != nil {
+			d.fail(key, err)
+			return
+		}
+		*v = s
+	}
+}
+
+// Int decodes member key into v
+func (d *Decoder) Int(key string, v *int) {
+	if data := d.value(key); data != nil {
+		i, err := strconv.Atoi(string(data))
+		if err != nil {
+			d.fail(key, errors.New("Not an integer"))
+			return
+		}
+		*v = i
+	}
+}
+
+// Float decodes member key into v
+func (d *Decoder) Float(key string, v *float64) {
+	if data := d.value(key); data != nil {
+		f, err := parseFloat(data)
+		if err != nil {
+			d.fail(key, err)
+			return
+		}
+		*v = f
+	}
+}
+
+// Bool decodes member key into v
+func (d *Decoder) Bool(key string, v *bool) {
+	if data := d.value(key); data != nil {
+		b, err := parseBool(data)
+		if err != nil {
+			d.fail(key, err)
+			return
+		}
+		*v = b
+	}
+}
+
+// Time decodes member key, an RFC 3339 string, into v
+func (d *Decoder) Time(key string, v *time.Time) {
+	var s string
+	d.String(key, &s)
+	if s == "" {
+		return
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		d.fail(key, err)
+		return
+	}
+	*v = t
+}
+
+// Elements of member key's array value.  ok is false if the member is
+// missing or isn't an array; null is true if the member is null.
+func (d *Decoder) array(key string) (elems [][]byte, null, ok bool) {
+	data, present := d.members[key]
+	if !present {
+		return nil, false, false
+	}
+	if string(data) == "null" {
+		return nil, true, true
+	}
+	elems, err := parseArray(data)
+	if err != nil {
+		d.fail(key, err)
+		return nil, false, false
+	}
+	return elems, false, true
+}
+
+// Strings decodes member key into v
+func (d *Decoder) Strings(key string, v *[]string) {
+	elems, null, ok := d.array(key)
+	if !ok {
+		return
+	}
+	if null {
+		*v = nil
+		return
+	}
+	s := make([]string, len(elems))
+	for i, elem := range elems {
+		var err error
+		if s[i], err = parseString(elem); err != nil {
+			d.fail(key, err)
+			return
+		}
+	}
+	*v = s
+}
+
+// Floats decodes member key into v
+func (d *Decoder) Floats(key string, v *[]float64) {
+	elems, null, ok := d.array(key)
+	if !ok {
+		return
+	}
+	if null {
+		*v = nil
+		return
+	}
+	f := make([]float64, len(elems))
+	for i, elem := range elems {
+		var err error
+		if f[i], err = parseFloat(elem); err != nil {
+			d.fail(key, err)
+			return
+		}
+	}
+	*v = f
+}
+
+// Bools decodes member key into v.  To decode into an array rather than a
+// slice, decode into a slice and copy.
+func (d *Decoder) Bools(key string, v *[]bool) {
+	elems, null, ok := d.array(key)
+	if !ok {
+		return
+	}
+	if null {
+		*v = nil
+		return
+	}
+	b := make([]bool, len(elems))
+	for i, elem := range elems {
+		var err error
+		if b[i], err = parseBool(elem); err != nil {
+			d.fail(key, err)
+			return
+		}
+	}
+	*v = b
+}
+
+// Object decodes member key's object value into v
+func (d *Decoder) Object(key string, v Unmarshaler) {
+	if data := d.value(key); data != nil {
+		if err := UnmarshalMerle(data, v); err != nil {
+			d.fail(key, err)
+		}
+	}
+}
+
+// JSON parsing, just enough to split objects and arrays into their values
+// and decode scalars
+
+var errSyntax = errors.New("Malformed JSON")
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func skipSpace(data []byte, i int) int {
+	for i < len(data) && isSpace(data[i]) {
+		i++
+	}
+	return i
+}
+
+// Skip the JSON value starting at data[i], returning the index after it
+func skipValue(data []byte, i int) (int, error) {
+	if i >= len(data) {
+		return 0, errSyntax
+	}
+
+	switch c := data[i]; {
+	case c == '"':
+		for i++; i < len(data); i++ {
+			switch data[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1, nil
+			}
+		}
+		return 0, errSyntax
+	case c == '{' || c == '[':
+		close := byte('}')
+		if c == '[' {
+			close = ']'
+		}
+		i = skipSpace(data, i+1)
+		if i < len(data) && data[i] == close {
+			return i + 1, nil
+		}
+		for {
+			var err error
+			if c == '{' {
+				if i, err = skipValue(data, i); err != nil {
+					return 0, err
+				}
+				i = skipSpace(data, i)
+				if i >= len(data) || data[i] != ':' {
+					return 0, errSyntax
+				}
+				i = skipSpace(data, i+1)
+			}
+			if i, err = skipValue(data, i); err != nil {
+				return 0, err
+			}
+			i = skipSpace(data, i)
+			if i >= len(data) {
+				return 0, errSyntax
+			}
+			if data[i] == close {
+				return i + 1, nil
+			}
+			if data[i] != ',' {
+				return 0, errSyntax
+			}
+			i = skipSpace(data, i+1)
+		}
+	default:
+		// Number or literal
+		start := i
+		for i < len(data) && !isSpace(data[i]) && data[i] != ',' &&
+			data[i] != '}' && data[i] != ']' {
+			i++
+		}
+		if i == start {
+			return 0, errSyntax
+		}
+		return i, nil
+	}
+}
+
+func parseObject(data []byte) (map[string][]byte, error) {
+	members := make(map[string][]byte)
+
+	i := skipSpace(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return nil, errors.New("Not a JSON object")
+	}
+	i = skipSpace(data, i+1)
+	if i < len(data) && data[i] == '}' {
+		return members, nil
+	}
+
+	for {
+		end, err := skipValue(data, i)
+		if err != nil || data[i] != '"' {
+			return nil, errSyntax
+		}
+		key, err := parseString(data[i:end])
+		if err != nil {
+			return nil, err
+		}
+
+		i = skipSpace(data, end)
+		if i >= len(data) || data[i] != ':' {
+			return nil, errSyntax
+		}
+		i = skipSpace(data, i+1)
+
+		end, err = skipValue(data, i)
+		if err != nil {
+			return nil, err
+		}
+		members[key] = data[i:end]
+
+		i = skipSpace(data, end)
+		if i >= len(data) {
+			return nil, errSyntax
+		}
+		if data[i] == '}' {
+			return members, nil
+		}
+		if data[i] != ',' {
+			return nil, errSyntax
+		}
+		i = skipSpace(data, i+1)
+	}
+}
+
+func parseArray(data []byte) ([][]byte, error) {
+	var elems [][]byte
+
+	if len(data) == 0 || data[0] != '[' {
+		return nil, errors.New("Not a JSON array")
+	}
+	i := skipSpace(data, 1)
+	if i < len(data) && data[i] == ']' {
+		return [][]byte{}, nil
+	}
+
+	for {
+		end, err := skipValue(data, i)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, data[i:end])
+
+		i = skipSpace(data, end)
+		if i >= len(data) {
+			return nil, errSyntax
+		}
+		if data[i] == ']' {
+			return elems, nil
+		}
+		if data[i] != ',' {
+			return nil, errSyntax
+		}
+		i = skipSpace(data, i+1)
+	}
+}
+
+func parseString(data []byte) (string, error) {
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return "", errors.New("Not a string")
+	}
+	data = data[1 : len(data)-1]
+
+	var buf []byte
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if c != '\\' {
+			buf = append(buf, c)
+			continue
+		}
+		i++
+		if i >= len(data) {
+			return "", errSyntax
+		}
+		switch data[i] {
+		case '"', '\\', '/':
+			buf = append(buf, data[i])
+		case 'b':
+			buf = append(buf, '\b')
+		case 'f':
+			buf = append(buf, '\f')
+		case 'n':
+			buf = append(buf, '\n')
+		case 'r':
+			buf = append(buf, '\r')
+		case 't':
+			buf = append(buf, '\t')
+		case 'u':
+			r, ok := parseHex(data[i+1:])
+			if !ok {
+				return "", errSyntax
+			}
+			i += 4
+			if utf16.IsSurrogate(r) && i+6 < len(data) &&
+				data[i+1] == '\\' && data[i+2] == 'u' {
+				r2, _ := parseHex(data[i+3:])
+				if dec := utf16.DecodeRune(r, r2); dec != utf8.RuneError {
+					r = dec
+					i += 6
+				}
+			}
+			buf = utf8.AppendRune(buf, r)
+		default:
+			return "", errSyntax
+		}
+	}
+
+	return string(buf), nil
+}
+
+func parseHex(data []byte) (rune, bool) {
+	if len(data) < 4 {
+		return 0, false
+	}
+	r, err := strconv.ParseUint(string(data[:4]), 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	return rune(r), true
+}
+
+func parseFloat(data []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return 0, errors.New("Not a number")
+	}
+	return f, nil
+}
+
+func parseBool(data []byte) (bool, error) {
+	switch string(data) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, errors.New("Not a boolean")
+}
+
+// MarshalMerle and UnmarshalMerle for merle's own messages, so they work on
+// TinyGo
+
+func (m *Msg) MarshalMerle(e *Encoder) {
+	e.String("Msg", m.Msg)
+}
+
+func (m *Msg) UnmarshalMerle(d *Decoder) error {
+	d.String("Msg", &m.Msg)
+	return d.Err()
+}
+
+func (m *MsgEventStatus) MarshalMerle(e *Encoder) {
+	e.String("Msg", m.Msg)
+	e.String("Id", m.Id)
+	e.Bool("Online", m.Online)
+}
+
+func (m *MsgEventStatus) UnmarshalMerle(d *Decoder) error {
+	d.String("Msg", &m.Msg)
+	d.String("Id", &m.Id)
+	d.Bool("Online", &m.Online)
+	return d.Err()
+}
+
+func (m *MsgGetIdentity) MarshalMerle(e *Encoder) {
+	e.String("Msg", m.Msg)
+	e.Strings("Codecs", m.Codecs)
+}
+
+func (m *MsgGetIdentity) UnmarshalMerle(d *Decoder) error {
+	d.String("Msg", &m.Msg)
+	d.Strings("Codecs", &m.Codecs)
+	return d.Err()
+}
+
+func (m *MsgIdentity) MarshalMerle(e *Encoder) {
+	e.String("Msg", m.Msg)
+	e.String("Id", m.Id)
+	e.String("Model", m.Model)
+	e.String("Name", m.Name)
+	e.Bool("Online", m.Online)
+	e.Time("StartupTime", m.StartupTime)
+	e.String("Codec", m.Codec)
+}
+
+func (m *MsgIdentity) UnmarshalMerle(d *Decoder) error {
+	d.String("Msg", &m.Msg)
+	d.String("Id", &m.Id)
+	d.String("Model", &m.Model)
+	d.String("Name", &m.Name)
+	d.Bool("Online", &m.Online)
+	d.Time("StartupTime", &m.StartupTime)
+	d.String("Codec", &m.Codec)
+	return d.Err()
+}
+
+func (m *MsgError) MarshalMerle(e *Encoder) {
+	e.String("Msg", m.Msg)
+	e.String("Error", m.Error)
+}
+
+func (m *MsgError) UnmarshalMerle(d *Decoder) error {
+	d.String("Msg", &m.Msg)
+	d.String("Error", &m.Error)
+	return d.Err()
+}
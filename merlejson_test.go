@@ -0,0 +1,164 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type merleSub struct {
+	Name string
+	Ok   bool
+}
+
+func (s *merleSub) MarshalMerle(e *Encoder) {
+	e.String("Name", s.Name)
+	e.Bool("Ok", s.Ok)
+}
+
+func (s *merleSub) UnmarshalMerle(d *Decoder) error {
+	d.String("Name", &s.Name)
+	d.Bool("Ok", &s.Ok)
+	return d.Err()
+}
+
+type merleState struct {
+	Msg    string
+	Count  int
+	Temp   float64
+	Led    bool
+	Ids    []string
+	Temps  []float64
+	States []bool
+	Sub    *merleSub
+}
+
+func (s *merleState) MarshalMerle(e *Encoder) {
+	e.String("Msg", s.Msg)
+	e.Int("Count", s.Count)
+	e.Float("Temp", s.Temp)
+	e.Bool("Led", s.Led)
+	e.Strings("Ids", s.Ids)
+	e.Floats("Temps", s.Temps)
+	e.Bools("States", s.States)
+	if s.Sub == nil {
+		e.Object("Sub", nil)
+	} else {
+		e.Object("Sub", s.Sub)
+	}
+}
+
+func (s *merleState) UnmarshalMerle(d *Decoder) error {
+	d.String("Msg", &s.Msg)
+	d.Int("Count", &s.Count)
+	d.Float("Temp", &s.Temp)
+	d.Bool("Led", &s.Led)
+	d.Strings("Ids", &s.Ids)
+	d.Floats("Temps", &s.Temps)
+	d.Bools("States", &s.States)
+	if d.Raw("Sub") != nil && string(d.Raw("Sub")) != "null" {
+		s.Sub = &merleSub{}
+		d.Object("Sub", s.Sub)
+	}
+	return d.Err()
+}
+
+// MarshalMerle must encode exactly as encoding/json does, and UnmarshalMerle
+// must decode encoding/json's output
+func TestMerleJSON(t *testing.T) {
+	start := time.Date(2022, 6, 1, 10, 0, 0, 500, time.UTC)
+
+	msgs := []interface{}{
+		&Msg{Msg: GetState},
+		&MsgEventStatus{Msg: EventStatus, Id: "child01", Online: true},
+		&MsgGetIdentity{Msg: GetIdentity, Codecs: []string{"cbor", "json"}},
+		&MsgGetIdentity{Msg: GetIdentity},
+		&MsgIdentity{Msg: ReplyIdentity, Id: "thing01", Model: "m",
+			Name: "n", Online: true, StartupTime: start, Codec: "json"},
+		&MsgError{Msg: ReplyError, Error: `Bad "thing" <here> & there`},
+		&merleState{Msg: ReplyState, Count: -3, Temp: 70.25, Led: true,
+			Ids:    []string{"a\n", "é", " ", "\x01"},
+			Temps:  []float64{0, 1e-7, 1e21, 123456789, -0.000001, 0.1},
+			States: []bool{true, false},
+			Sub:    &merleSub{Name: "sub", Ok: true}},
+		&merleState{Ids: []string{}},
+	}
+
+	for _, msg := range msgs {
+		want, _ := json.Marshal(msg)
+		got := MarshalMerle(msg.(Marshaler))
+		if string(got) != string(want) {
+			t.Errorf("MarshalMerle(%T)\n got %s\nwant %s", msg, got, want)
+		}
+
+		fresh := reflect.New(reflect.TypeOf(msg).Elem()).Interface()
+		if err := UnmarshalMerle(want, fresh.(Unmarshaler)); err != nil {
+			t.Errorf("UnmarshalMerle(%s) failed: %s", want, err)
+			continue
+		}
+		var jsonFresh = reflect.New(reflect.TypeOf(msg).Elem()).Interface()
+		json.Unmarshal(want, jsonFresh)
+		if !reflect.DeepEqual(fresh, jsonFresh) {
+			t.Errorf("UnmarshalMerle(%s)\n got %+v\nwant %+v", want,
+				fresh, jsonFresh)
+		}
+	}
+}
+
+func TestMerleDecoder(t *testing.T) {
+	data := []byte(` { "Msg" : "Update", "Extra": {"a": [1, {"b": "]}"}]},
+		"Count": 7, "Ids": null, "Sub": null,
+		"Temp": 1.5e2, "Emoji": "😀 é\/" } `)
+
+	s := merleState{Ids: []string{"x"}, Led: true}
+	if err := UnmarshalMerle(data, &s); err != nil {
+		t.Fatalf("UnmarshalMerle failed: %s", err)
+	}
+	want := merleState{Msg: "Update", Count: 7, Temp: 150, Led: true}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("Decoded %+v, want %+v", s, want)
+	}
+
+	// Invalid UTF-8 is replaced with U+FFFD
+	var bad merleState
+	json.Unmarshal(MarshalMerle(&merleState{Msg: "a\xffb"}), &bad)
+	if bad.Msg != "a\ufffdb" {
+		t.Errorf("Invalid UTF-8 encoded as %q", bad.Msg)
+	}
+
+	members, _ := parseObject(data)
+	emoji, _ := parseString(members["Emoji"])
+	if emoji != "😀 é/" {
+		t.Errorf("Decoded %q, want \"😀 é/\"", emoji)
+	}
+
+	malformed := []string{
+		``,
+		`[]`,
+		`{"Msg":}`,
+		`{"Msg":"x"`,
+		`{"Msg" "x"}`,
+		`{"Msg":"x",}`,
+		`{"Msg":"x\q"}`,
+		`{"Count":"7"}`,
+		`{"Count":7.5}`,
+		`{"Led":1}`,
+		`{"Ids":["a",1]}`,
+		`{"States":{}}`,
+	}
+
+	for _, b := range malformed {
+		var s merleState
+		if err := UnmarshalMerle([]byte(b), &s); err == nil {
+			t.Errorf("UnmarshalMerle(%s) should have failed", b)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Package merletest is an in-memory harness for unit-testing Thingers.
+//
+// The harness builds a Thing around the Thinger under test, without web
+// servers, websockets, tunnels or ports, and plugs fake sockets into the
+// Thing's bus.  A test sends messages in on a fake socket, and asserts on the
+// replies and broadcasts the socket gets back:
+//
+//	func TestClick(t *testing.T) {
+//		h := merletest.New(t, relays.NewRelays(), merletest.AsPrime())
+//
+//		browser := h.Socket("browser")
+//		browser.Handshake()
+//		other := h.Socket("other")
+//		other.Handshake()
+//
+//		browser.Send(&relays.MsgClick{Msg: "Click", Relay: 1, State: true})
+//
+//		var click relays.MsgClick
+//		other.Expect("Click", &click)
+//		browser.ExpectNone()
+//	}
+//
+// Prime() and Bridge() simulate the Thing Prime or bridge a Thing is
+// connected to, and AsPrime() runs the Thinger under test as Thing Prime.
+package merletest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/merliot/merle"
+)
+
+// How long Next() and Expect() wait for a Packet
+var Timeout = time.Second
+
+// How long ExpectNone() waits to be sure no Packet is coming
+var Quiet = 20 * time.Millisecond
+
+// Id given to the Thing under test, unless set with Config()
+const Id = "merletest"
+
+// A Harness is a Thing, built around the Thinger under test, with an
+// in-memory bus
+type Harness struct {
+	tb testing.TB
+	// The Thing under test
+	Thing    *merle.Thing
+	prime    bool
+	sockLock sync.Mutex
+	socks    []*Socket
+}
+
+// An Option configures the Harness
+type Option func(*Harness)
+
+// AsPrime runs the Thinger under test as Thing Prime.  p.IsThing() is false
+// in the Thinger's handlers, and CmdInit isn't sent.
+func AsPrime() Option {
+	return func(h *Harness) {
+		h.prime = true
+	}
+}
+
+// Config adjusts the Thing's configuration before the Thing is built
+func Config(f func(cfg *merle.ThingConfig)) Option {
+	return func(h *Harness) {
+		f(&h.Thing.Cfg)
+	}
+}
+
+// New builds a Thing around thinger, sends the Thing CmdInit, and returns the
+// Harness.  CmdRun isn't sent; inject CmdRun with h.Thing.Inject() if the
+// test wants the Thinger's main loop running.  Logging is disabled, unless
+// enabled with Config().  Fake sockets are unplugged when the test finishes.
+func New(tb testing.TB, thinger merle.Thinger, opts ...Option) *Harness {
+	tb.Helper()
+
+	h := &Harness{tb: tb, Thing: merle.NewThing(thinger)}
+
+	h.Thing.Cfg.Id = Id
+	h.Thing.Cfg.LoggingEnabled = false
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	h.Thing.Cfg.IsPrime = h.prime
+
+	if err := h.Thing.Build(); err != nil {
+		tb.Fatalf("Building Thing failed: %s", err)
+	}
+
+	tb.Cleanup(h.close)
+
+	if !h.prime {
+		h.Thing.Inject(&merle.Msg{Msg: merle.CmdInit})
+	}
+
+	return h
+}
+
+func (h *Harness) close() {
+	h.sockLock.Lock()
+	socks := h.socks
+	h.socks = nil
+	h.sockLock.Unlock()
+
+	for _, s := range socks {
+		s.Close()
+	}
+}
+
+// Socket plugs a new fake socket into the Thing's bus.  The socket is like a
+// browser connected to the Thing; messages sent on the socket come from
+// src, as seen by p.Src().
+func (h *Harness) Socket(src string) *Socket {
+	return h.socket("merletest:"+src, src, h.Thing.Plugin)
+}
+
+func (h *Harness) socket(name, src string,
+	plugin func(merle.Socket) (*merle.Plug, error)) *Socket {
+	h.tb.Helper()
+
+	s := &Socket{
+		tb:   h.tb,
+		name: name,
+		src:  src,
+		pkts: make(chan *merle.Packet, 256),
+	}
+
+	plug, err := plugin(&fakeEnd{s})
+	if err != nil {
+		h.tb.Fatalf("Plugging in socket failed: %s", err)
+	}
+	s.plug = plug
+
+	h.sockLock.Lock()
+	h.socks = append(h.socks, s)
+	h.sockLock.Unlock()
+
+	return s
+}
+
+// parent plugs in a fake socket for the Thing's parent, and does the parent's
+// handshake with the Thing: GetIdentity, then GetState.
+func (h *Harness) parent(name string) (*Socket, *merle.MsgIdentity) {
+	h.tb.Helper()
+
+	s := h.socket(name, h.Thing.Cfg.Id, h.Thing.Plugin)
+
+	var identity merle.MsgIdentity
+	s.Send(&merle.Msg{Msg: merle.GetIdentity})
+	s.Expect(merle.ReplyIdentity, &identity)
+
+	s.Handshake()
+
+	return s, &identity
+}
+
+// Prime simulates Thing Prime connected to the Thing.  Prime plugs in a fake
+// socket for Thing Prime and does Thing Prime's handshake with the Thing:
+// GetIdentity, then GetState.  Prime returns the socket, enabled for
+// broadcasts, and the Thing's identity.  The Thing's ReplyState is consumed.
+func (h *Harness) Prime() (*Socket, *merle.MsgIdentity) {
+	h.tb.Helper()
+	return h.parent("port:prime")
+}
+
+// Bridge simulates a bridge the Thing is attached to, as a child.  The
+// bridge's handshake with the Thing is the same as Thing Prime's; see Prime().
+func (h *Harness) Bridge() (*Socket, *merle.MsgIdentity) {
+	h.tb.Helper()
+	return h.parent("port:bridge")
+}
+
+// Real simulates the real Thing connected to the Thinger under test running as
+// Thing Prime (see AsPrime()).  Send the real Thing's ReplyState and updates
+// on the socket; messages Thing Prime broadcasts are received on the socket
+// once the real Thing's ReplyState is sent.  Messages sent on the socket are
+// handled as Thing Prime handles messages from the real Thing on its port:
+// StatePatches are applied before reaching Subscribers(), and the ReplyState
+// brings Thing online (see Thing.PluginThing).
+func (h *Harness) Real() *Socket {
+	h.tb.Helper()
+	return h.socket("port:thing", h.Thing.Cfg.Id, h.Thing.PluginThing)
+}
+
+// A Socket is a fake socket plugged into the Thing's bus.  Packets the Thing
+// sends to the socket, replies and broadcasts alike, queue on the socket,
+// in order, for the test to assert on with Next(), Expect() and
+// ExpectNone().  Call these from the test's goroutine.
+type Socket struct {
+	tb   testing.TB
+	name string
+	src  string
+	plug *merle.Plug
+	pkts chan *merle.Packet
+	once sync.Once
+}
+
+// fakeEnd is the Thing's end of a fake socket
+type fakeEnd struct {
+	s *Socket
+}
+
+func (e *fakeEnd) Name() string {
+	return e.s.name
+}
+
+func (e *fakeEnd) Src() string {
+	return e.s.src
+}
+
+func (e *fakeEnd) Send(p *merle.Packet) error {
+	select {
+	case e.s.pkts <- p:
+	default:
+		e.s.tb.Errorf("Socket [%s] overflowed; dropped %.80s",
+			e.s.name, p.String())
+	}
+	return nil
+}
+
+// Name of the socket, as seen by p.SrcName()
+func (s *Socket) Name() string {
+	return s.name
+}
+
+// Send message msg to the Thing, on the socket.  The message is matched
+// against the Thinger's Subscribers().
+func (s *Socket) Send(msg interface{}) {
+	s.plug.Receive(msg)
+}
+
+// Next returns the next Packet the Thing sent to the socket.  The test fails
+// if no Packet arrives within Timeout.
+func (s *Socket) Next() *merle.Packet {
+	s.tb.Helper()
+
+	select {
+	case p := <-s.pkts:
+		return p
+	case <-time.After(Timeout):
+		s.tb.Fatalf("Socket [%s]: no message within %s", s.name, Timeout)
+	}
+	return nil
+}
+
+// Expect the next Packet the Thing sent to the socket to be message msg.  If
+// v is not nil, the message is decoded into v.  The test fails if the next
+// Packet isn't msg, or doesn't decode into v.
+func (s *Socket) Expect(msg string, v interface{}) *merle.Packet {
+	s.tb.Helper()
+
+	p := s.Next()
+
+	var m merle.Msg
+	p.Unmarshal(&m)
+	if m.Msg != msg {
+		s.tb.Fatalf("Socket [%s]: got %.80s, want message %s", s.name,
+			p.String(), msg)
+	}
+
+	if v != nil {
+		if err := p.Unmarshal(v); err != nil {
+			s.tb.Fatalf("Socket [%s]: decoding %.80s failed: %s",
+				s.name, p.String(), err)
+		}
+	}
+
+	return p
+}
+
+// ExpectNone expects the Thing sent nothing (more) to the socket.  The test
+// fails if a Packet arrives within Quiet.
+func (s *Socket) ExpectNone() {
+	s.tb.Helper()
+
+	select {
+	case p := <-s.pkts:
+		s.tb.Fatalf("Socket [%s]: got unexpected %.80s", s.name,
+			p.String())
+	case <-time.After(Quiet):
+	}
+}
+
+// Handshake does the GetState/ReplyState handshake, which enables the socket
+// for broadcasts, the same as a browser or Thing Prime would.  The
+// ReplyState is returned.  Any retained messages follow the ReplyState on the
+// socket.
+func (s *Socket) Handshake() *merle.Packet {
+	s.tb.Helper()
+
+	s.Send(&merle.Msg{Msg: merle.GetState})
+	return s.Expect(merle.ReplyState, nil)
+}
+
+// Close unplugs the socket from the Thing's bus
+func (s *Socket) Close() {
+	s.once.Do(s.plug.Unplug)
+}
@@ -0,0 +1,172 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merletest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/merliot/merle"
+)
+
+type counter struct {
+	sync.Mutex
+	Msg    string
+	Count  int
+	inited bool
+	primed bool
+}
+
+func (c *counter) init(p *merle.Packet) {
+	c.inited = true
+}
+
+func (c *counter) getState(p *merle.Packet) {
+	c.Lock()
+	c.Msg = merle.ReplyState
+	p.Marshal(c)
+	c.Unlock()
+	p.Reply()
+}
+
+func (c *counter) saveState(p *merle.Packet) {
+	c.Lock()
+	p.Unmarshal(c)
+	c.primed = !p.IsThing()
+	c.Unlock()
+}
+
+func (c *counter) inc(p *merle.Packet) {
+	c.Lock()
+	c.Count++
+	c.Msg = "Count"
+	p.Marshal(c)
+	c.Unlock()
+	p.Broadcast()
+}
+
+func (c *counter) Subscribers() merle.Subscribers {
+	return merle.Subscribers{
+		merle.CmdInit:    c.init,
+		merle.GetState:   c.getState,
+		merle.ReplyState: c.saveState,
+		"Inc":            c.inc,
+	}
+}
+
+func (c *counter) Assets() *merle.ThingAssets {
+	return &merle.ThingAssets{}
+}
+
+func TestHarness(t *testing.T) {
+	c := &counter{}
+	h := New(t, c)
+
+	if !c.inited {
+		t.Fatalf("CmdInit not sent")
+	}
+
+	a := h.Socket("a")
+	b := h.Socket("b")
+	a.Handshake()
+
+	// b hasn't done the handshake, so gets no broadcasts
+	b.Send(&merle.Msg{Msg: "Inc"})
+
+	var got counter
+	a.Expect("Count", &got)
+	if got.Count != 1 {
+		t.Errorf("Count %d, want 1", got.Count)
+	}
+	b.ExpectNone()
+
+	b.Handshake()
+	a.Send(&merle.Msg{Msg: "Inc"})
+	b.Expect("Count", &got)
+	a.ExpectNone()
+
+	// Unplugged sockets get nothing
+	b.Close()
+	h.Socket("c").Send(&merle.Msg{Msg: "Inc"})
+	a.Expect("Count", nil)
+}
+
+func TestHarnessParent(t *testing.T) {
+	h := New(t, &counter{}, Config(func(cfg *merle.ThingConfig) {
+		cfg.Id = "counter01"
+		cfg.Model = "counter"
+	}))
+
+	for _, parent := range []func() (*Socket, *merle.MsgIdentity){
+		h.Prime, h.Bridge} {
+		sock, identity := parent()
+		if identity.Id != "counter01" || identity.Model != "counter" {
+			t.Errorf("Identity %+v, want counter01/counter", identity)
+		}
+
+		h.Socket("browser").Send(&merle.Msg{Msg: "Inc"})
+		sock.Expect("Count", nil)
+	}
+}
+
+func TestHarnessPrime(t *testing.T) {
+	c := &counter{}
+	h := New(t, c, AsPrime())
+
+	if c.inited {
+		t.Errorf("CmdInit sent to Thing Prime")
+	}
+
+	real := h.Real()
+	real.Send(&counter{Msg: merle.ReplyState, Count: 41})
+	if c.Count != 41 || !c.primed {
+		t.Errorf("Count %d, primed %t; want 41, true", c.Count, c.primed)
+	}
+
+	browser := h.Socket("browser")
+	browser.Handshake()
+	browser.Send(&merle.Msg{Msg: "Inc"})
+
+	var got counter
+	real.Expect("Count", &got)
+	if got.Count != 42 {
+		t.Errorf("Count %d, want 42", got.Count)
+	}
+}
+
+func TestHarnessReal(t *testing.T) {
+	c := &counter{}
+	h := New(t, c, AsPrime())
+
+	browser := h.Socket("browser")
+	browser.Handshake()
+
+	real := h.Real()
+	real.Send(&counter{Msg: merle.ReplyState, Count: 41})
+
+	var status merle.MsgEventStatus
+	browser.Expect(merle.EventStatus, &status)
+	if !status.Online {
+		t.Errorf("Thing offline after ReplyState")
+	}
+
+	// The StatePatch reaches Subscribers() as the patched state
+	real.Send(&merle.MsgStatePatch{
+		Msg: merle.StatePatch,
+		Patch: []merle.PatchOp{
+			{Op: "replace", Path: "/Count", Value: []byte("43")},
+		},
+	})
+	if c.Count != 43 {
+		t.Errorf("Count %d, want 43", c.Count)
+	}
+	browser.Expect(merle.StatePatch, nil)
+
+	real.Close()
+	browser.Expect(merle.EventStatus, &status)
+	if status.Online {
+		t.Errorf("Thing online after real Thing unplugged")
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+// Direction of a Packet moving through the bus
+type Direction int
+
+const (
+	// Packet received on bus, on its way to Subscribers()
+	DirReceive Direction = iota
+	// Packet sent back to its source with Reply()
+	DirReply
+	// Packet sent to everyone else on the bus with Broadcast()
+	DirBroadcast
+	// Packet sent to a destination with Send() or Request()
+	DirSend
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirReceive:
+		return "receive"
+	case DirReply:
+		return "reply"
+	case DirBroadcast:
+		return "broadcast"
+	case DirSend:
+		return "send"
+	}
+	return "unknown"
+}
+
+// Middleware intercepts Packets moving through a Thing's bus.  Middleware
+// sees every Packet received, replied, broadcast or sent on the bus, along
+// with the Packet's direction.  The Packet's source is available with
+// p.Src() and p.SrcName().
+//
+// Middleware passes the Packet on by calling next.  Middleware can modify the
+// Packet before passing it on, or drop the Packet by not calling next.  Here
+// is an example middleware which drops "Reboot" messages from anyone other
+// than the system:
+//
+//	func guard(p *merle.Packet, dir merle.Direction, next func(*merle.Packet)) {
+//		var msg merle.Msg
+//		p.Unmarshal(&msg)
+//		if dir == merle.DirReceive && msg.Msg == "Reboot" &&
+//			p.Src() != "SYSTEM" {
+//			return // drop
+//		}
+//		next(p)
+//	}
+//
+// Middleware is registered either in the Thing's configuration:
+//
+//	thing.Cfg.Middleware = []merle.Middleware{merle.MiddlewareFunc(guard)}
+//
+// or by a Thinger implementing the Interceptor interface.  Middleware runs in
+// the order registered, configuration middleware first.
+//
+// Middleware runs on the go func delivering the Packet, so don't block in
+// Middleware.
+type Middleware interface {
+	Intercept(p *Packet, dir Direction, next func(*Packet))
+}
+
+// MiddlewareFunc is an adapter to use an ordinary function as Middleware.
+type MiddlewareFunc func(p *Packet, dir Direction, next func(*Packet))
+
+// Intercept calls f(p, dir, next)
+func (f MiddlewareFunc) Intercept(p *Packet, dir Direction, next func(*Packet)) {
+	f(p, dir, next)
+}
+
+// A Thing implementing the Interceptor interface registers Middleware on the
+// Thing's bus.
+type Interceptor interface {
+
+	// List of Middleware, in the order to run.  E.g.:
+	//
+	//	func (t *thing) Middleware() []merle.Middleware {
+	//		return []merle.Middleware{
+	//			merle.MiddlewareFunc(t.audit),
+	//			merle.MiddlewareFunc(t.guard),
+	//		}
+	//	}
+	Middleware() []Middleware
+}
+
+// Add middleware to bus
+func (b *bus) use(mws ...Middleware) {
+	for _, mw := range mws {
+		if mw != nil {
+			b.mws = append(b.mws, mw)
+		}
+	}
+}
+
+// Run Packet through the middleware chain, ending with final
+func (b *bus) intercept(p *Packet, dir Direction, final func(*Packet)) {
+	var next func(i int) func(*Packet)
+
+	next = func(i int) func(*Packet) {
+		if i == len(b.mws) {
+			return final
+		}
+		return func(p *Packet) {
+			b.mws[i].Intercept(p, dir, next(i+1))
+		}
+	}
+
+	next(0)(p)
+}
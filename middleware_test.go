@@ -0,0 +1,78 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"strings"
+	"testing"
+)
+
+type audited struct {
+	counter
+	log []string
+}
+
+func (a *audited) audit(p *Packet, dir Direction, next func(*Packet)) {
+	var msg Msg
+	p.Unmarshal(&msg)
+	a.log = append(a.log, dir.String()+":"+msg.Msg)
+	next(p)
+}
+
+func (a *audited) guard(p *Packet, dir Direction, next func(*Packet)) {
+	var msg Msg
+	p.Unmarshal(&msg)
+	switch msg.Msg {
+	case "Secret":
+		// drop
+	case "Rename":
+		next(p.Marshal(&Msg{Msg: "Count"}))
+	default:
+		next(p)
+	}
+}
+
+func (a *audited) Middleware() []Middleware {
+	return []Middleware{
+		MiddlewareFunc(a.audit),
+		MiddlewareFunc(a.guard),
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var child audited
+	var cfgDirs []string
+
+	cfg := func(p *Packet, dir Direction, next func(*Packet)) {
+		cfgDirs = append(cfgDirs, dir.String())
+		next(p)
+	}
+
+	mother := NewThing(&sparse{})
+	mother.Cfg.Middleware = []Middleware{MiddlewareFunc(cfg)}
+
+	wire(t, mother, NewThing(&child))
+
+	mother.SendTo("child", &Msg{Msg: "Count"})
+	mother.Broadcast(&Msg{Msg: "Secret"})
+	mother.Broadcast(&Msg{Msg: "Rename"})
+
+	want := "receive:Count,receive:Secret,receive:Rename"
+	if got := strings.Join(child.log, ","); got != want {
+		t.Errorf("Audit got %s, want %s", got, want)
+	}
+
+	if len(child.srcs) != 2 {
+		t.Errorf("Child counted %d msgs, want 2", len(child.srcs))
+	}
+
+	want = "send,broadcast,broadcast"
+	if got := strings.Join(cfgDirs, ","); got != want {
+		t.Errorf("Config middleware got %s, want %s", got, want)
+	}
+}
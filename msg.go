@@ -12,13 +12,19 @@ const (
 	// Thing can optionally subscribe and handle CmdInit via Subscribers(),
 	// to initialize Thing's state.
 	//
+	// If Thing has a persistent state store (see ThingConfig.StateDir),
+	// CmdInit carries Thing's saved state; restore it in the CmdInit
+	// handler with p.RestoreState().
+	//
 	// CmdInit is not sent to Thing Prime.  Thing Prime will get its
 	// initial state with a GetState call to Thing.
 	CmdInit = "_CmdInit"
 
 	// CmdRun is Thing's main loop.  All Things must subscribe and handle
 	// CmdRun, via Subscribers().  CmdRun should run forever; it is an error
-	// for CmdRun handler to exit.
+	// for CmdRun handler to exit, unless the Thing is being stopped.  When
+	// Thing is stopped, CmdRun handler should return after CmdStop (see
+	// CmdStop).
 	//
 	// CmdRun is not sent to Thing Prime.  Thing Prime does not have a main
 	// loop.
@@ -28,6 +34,18 @@ const (
 	// is optional and doesn't need to run forever.
 	CmdRun = "_CmdRun"
 
+	// CmdStop is sent to Thing when Thing is stopped, either by calling
+	// thing.Stop() or by cancelling the context passed to
+	// thing.RunContext().  Thing can optionally subscribe and handle
+	// CmdStop via Subscribers(), to put the device into a safe state
+	// before Thing is torn down.  CmdRun handler is still running when
+	// CmdStop is received, and should return once CmdStop is handled.
+	// Thing waits up to 5 seconds for CmdRun handler to return, and then
+	// tears down, even if CmdRun handler is still running.
+	//
+	// CmdStop is not sent to Thing Prime.
+	CmdStop = "_CmdStop"
+
 	// GetIdentity requests Thing's identity.  Thing does not need to
 	// subscribe to GetIdentity.  Thing will internally respond with a
 	// ReplyIdentity message.
@@ -75,11 +93,38 @@ const (
 	//  }
 	ReplyState = "_ReplyState"
 
+	// StatePatch is an unsolicited notification that Thing's state has
+	// changed.  Rather than the whole state, StatePatch carries only the
+	// changes since the last StatePatch, as a JSON Patch (RFC 6902).  See
+	// StateDiff.
+	//
+	// Thing Prime (and a bridge, for its children) applies StatePatch to
+	// its copy of Thing's state, passes the patched state to Subscribers()
+	// as a ReplyState message, and broadcasts the StatePatch on to
+	// browsers.  The JS helper served at /merle.js applies StatePatch in
+	// the browser.
+	//
+	// StatePatch message is coded as MsgStatePatch.
+	StatePatch = "_StatePatch"
+
 	// EventStatus message is an unsolicited notification that a child
 	// Thing's connection status has changed.
 	//
 	// EventStatus message is coded as MsgEventStatus.
 	EventStatus = "_EventStatus"
+
+	// EventTunnel message is an unsolicited notification that the tunnel
+	// to Thing's mother has changed state.
+	//
+	// EventTunnel message is coded as MsgEventTunnel.
+	EventTunnel = "_EventTunnel"
+
+	// ReplyError is the reply to a request (see Packet.Request()) which
+	// couldn't be processed, for example because the request message was
+	// malformed.
+	//
+	// ReplyError message is coded as MsgError.
+	ReplyError = "_ReplyError"
 )
 
 // All messages in Merle build on this basic struct.  All messages have a
@@ -105,7 +150,47 @@ type MsgEventStatus struct {
 	Online bool
 }
 
-// Thing identification message return in ReplyIdentity
+// Tunnel states in MsgEventTunnel
+const (
+	// Getting a port from mother and setting up the tunnel
+	TunnelConnecting = "connecting"
+	// Tunnel is up
+	TunnelConnected = "connected"
+	// Tunnel failed or dropped; waiting to try again
+	TunnelBackoff = "backoff"
+	// Tunnel stopped with Thing
+	TunnelStopped = "stopped"
+)
+
+// Tunnel state change notification message.  On each change, the message is
+// sent to Thing's Subscribers() and broadcast to all listeners (browsers) on
+// Thing.  The broadcast is retained (see Packet.Retain()), so a browser
+// joining later sees the tunnel's current state.
+type MsgEventTunnel struct {
+	Msg string
+	// One of TunnelConnecting, TunnelConnected, TunnelBackoff or
+	// TunnelStopped
+	State string
+	// Mother's port for the tunnel, if TunnelConnected
+	Port uint
+	// Why the tunnel failed or dropped, if TunnelBackoff
+	Error string
+	// Attempts in a row which have failed
+	Failures uint
+	// Seconds until the next attempt, if TunnelBackoff
+	Backoff float64
+}
+
+// Identity request message sent in GetIdentity.  Codecs lists the Codecs the
+// requester can use on the connection, in order of preference.  See Codec.
+type MsgGetIdentity struct {
+	Msg    string
+	Codecs []string
+}
+
+// Thing identification message return in ReplyIdentity.  Codec is the Codec
+// the Thing picked for the connection from the Codecs offered in
+// GetIdentity.
 type MsgIdentity struct {
 	Msg         string
 	Id          string
@@ -113,4 +198,11 @@ type MsgIdentity struct {
 	Name        string
 	Online      bool
 	StartupTime time.Time
+	Codec       string
+}
+
+// Error message returned in ReplyError
+type MsgError struct {
+	Msg   string
+	Error string
 }
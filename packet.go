@@ -13,6 +13,12 @@ type Packet struct {
 	src socketer
 	// Message
 	msg []byte
+	// Request Id, if Packet is a Request; used to tag the reply
+	reqId string
+	// Message prepared once for sending on many websockets, on Broadcast
+	prep interface{}
+	// Keep as last value for message type, on Broadcast
+	retain bool
 }
 
 func newPacket(bus *bus, src socketer, msg interface{}) *Packet {
@@ -22,18 +28,20 @@ func newPacket(bus *bus, src socketer, msg interface{}) *Packet {
 }
 
 func (p *Packet) clone(bus *bus, src socketer) *Packet {
-	return &Packet{bus: bus, src: src, msg: p.msg}
+	return &Packet{bus: bus, src: src, msg: p.msg, reqId: p.reqId, prep: p.prep}
 }
 
 // JSON-encode the message into the Packet
 func (p *Packet) Marshal(msg interface{}) *Packet {
 	p.msg, _ = jsonMarshal(msg)
+	p.prep = nil
 	return p
 }
 
-// JSON-decode the message from the Packet
-func (p *Packet) Unmarshal(msg interface{}) {
-	jsonUnmarshal(p.msg, msg)
+// JSON-decode the message from the Packet.  An error is returned if the
+// message can't be decoded into msg.
+func (p *Packet) Unmarshal(msg interface{}) error {
+	return jsonUnmarshal(p.msg, msg)
 }
 
 // String representation of Packet message
@@ -41,15 +49,35 @@ func (p *Packet) String() string {
 	return string(p.msg)
 }
 
+// Source of Packets originating internally
+const systemSrc = "SYSTEM"
+
 // Src is the Packet's originating Thing's Id.  If the Packet originated
 // internally, then Src() is "SYSTEM".
 func (p *Packet) Src() string {
 	if p.src == nil {
-		return "SYSTEM"
+		return systemSrc
 	}
 	return p.src.Src()
 }
 
+// SrcName is the name of the Packet's source socket, for example
+// "ws:10.0.0.5:51234/ws/thing01".  If the Packet originated internally, then
+// SrcName() is "SYSTEM".
+func (p *Packet) SrcName() string {
+	if p.src == nil {
+		return systemSrc
+	}
+	return p.src.Name()
+}
+
+// Thing the Packet lives on.  Hang onto the Thing to send messages from
+// outside of subscriber handlers, with thing.NewPacket(), thing.Broadcast(),
+// etc.
+func (p *Packet) Thing() *Thing {
+	return p.bus.thing
+}
+
 // Reply back to sender of Packet.  Do not hold locks when calling Reply().
 func (p *Packet) Reply() {
 	p.bus.reply(p)
@@ -61,6 +89,24 @@ func (p *Packet) Broadcast() {
 	p.bus.broadcast(p)
 }
 
+// Retain marks the Packet as retained, like an MQTT retained message.  When
+// a retained Packet is broadcast, the bus keeps the Packet as the last value
+// for its message type.  A socket which joins the bus later gets the last
+// value for each retained message type, in the order first retained, right
+// after the socket's ReplyState handshake.  So a late-joining browser sees
+// the latest "Alarm", say, without Thing folding every "Alarm" into its
+// ReplyState:
+//
+//	p.Marshal(&alarm).Retain().Broadcast()
+//
+// Retained values live on the bus they were broadcast on.  To retain a
+// message on Thing Prime as well, Retain() it again on Prime before
+// broadcasting.
+func (p *Packet) Retain() *Packet {
+	p.retain = true
+	return p
+}
+
 // Send Packet to destination
 // TODO: Use restrictions?  Only to be called from bridge, or could be called
 // TODO: from child to talk to another child, over a bridge?
@@ -101,7 +147,8 @@ func Broadcast(p *Packet) {
 func NoInit(p *Packet) {
 }
 
-// Subscriber helper function to run forever.  Only applicable for CmdRun.
+// Subscriber helper function to run forever, or until Thing is stopped (see
+// CmdStop).  Only applicable for CmdRun.
 //
 //	return merle.Subscribers{
 //		...
@@ -114,7 +161,7 @@ func RunForever(p *Packet) {
 	if msg.Msg != CmdRun {
 		return
 	}
-	select {}
+	<-p.bus.thing.stopped
 }
 
 // Subscriber helper function to return empty state in response to GetState.
@@ -0,0 +1,305 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// State change notification message sent in StatePatch.  Patch is a JSON
+// Patch (RFC 6902) against the previous state.
+type MsgStatePatch struct {
+	Msg   string
+	Patch []PatchOp
+}
+
+// A JSON Patch (RFC 6902) operation.  StateDiff generates "add", "remove"
+// and "replace" operations.  Value is the value for "add" and "replace"
+// operations.
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// StateDiff tracks the last state sent by a Thing, so only the changes in
+// state need to be sent.  StateDiff is opt-in: a Thing which would otherwise
+// broadcast its whole state on every change can instead broadcast a
+// StatePatch with just the changed fields.
+//
+//	type thing struct {
+//		sync.Mutex
+//		diff merle.StateDiff
+//		Msg  string
+//		Temp int
+//		Hum  int
+//	}
+//
+//	func (t *thing) sample(p *merle.Packet) {
+//		t.Lock()
+//		t.Temp, t.Hum = readSensor()
+//		patch := t.diff.Patch(t)
+//		t.Unlock()
+//		if patch != nil {
+//			p.Marshal(patch).Broadcast()
+//		}
+//	}
+//
+// The state's top-level Msg member isn't part of the diff.  The first patch
+// adds every member of the state.  ReplyState is still sent in full in reply
+// to GetState; Thing Prime and the JS helper apply later patches to it.
+type StateDiff struct {
+	sync.Mutex
+	last interface{}
+}
+
+// Patch returns a StatePatch message with the changes in state since the
+// last call to Patch, or nil if state hasn't changed.  State is anything
+// that JSON-encodes to an object, typically the Thing's type struct.
+func (d *StateDiff) Patch(state interface{}) *MsgStatePatch {
+	msg, err := json.Marshal(state)
+	if err != nil {
+		return nil
+	}
+
+	next, err := decodeState(msg)
+	if err != nil {
+		return nil
+	}
+	if m, ok := next.(map[string]interface{}); ok {
+		delete(m, "Msg")
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.last == nil {
+		// First patch adds everything
+		d.last = map[string]interface{}{}
+	}
+
+	ops := diffState(nil, "", d.last, next)
+	d.last = next
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	return &MsgStatePatch{Msg: StatePatch, Patch: ops}
+}
+
+// Decode JSON-encoded state, keeping numbers as json.Number so they
+// re-encode as they were
+func decodeState(msg []byte) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(msg))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func patchOp(op, path string, v interface{}) PatchOp {
+	value, _ := json.Marshal(v)
+	return PatchOp{Op: op, Path: path, Value: value}
+}
+
+// JSON Pointer (RFC 6901) token escaping
+var (
+	tokenEscaper   = strings.NewReplacer("~", "~0", "/", "~1")
+	tokenUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+)
+
+// Append to ops the operations to patch a into b, at path.  Objects are
+// diffed member by member, and arrays of the same length element by
+// element.  Anything else which changed is replaced whole.
+func diffState(ops []PatchOp, path string, a, b interface{}) []PatchOp {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			return append(ops, patchOp("replace", path, b))
+		}
+		for _, key := range sortedKeys(av) {
+			keyPath := path + "/" + tokenEscaper.Replace(key)
+			if _, ok := bv[key]; !ok {
+				ops = append(ops, PatchOp{Op: "remove", Path: keyPath})
+				continue
+			}
+			ops = diffState(ops, keyPath, av[key], bv[key])
+		}
+		for _, key := range sortedKeys(bv) {
+			if _, ok := av[key]; !ok {
+				keyPath := path + "/" + tokenEscaper.Replace(key)
+				ops = append(ops, patchOp("add", keyPath, bv[key]))
+			}
+		}
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return append(ops, patchOp("replace", path, b))
+		}
+		for i := range av {
+			ops = diffState(ops, path+"/"+strconv.Itoa(i), av[i], bv[i])
+		}
+	default:
+		if !reflect.DeepEqual(a, b) {
+			ops = append(ops, patchOp("replace", path, b))
+		}
+	}
+	return ops
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Apply JSON Patch ops to JSON-encoded state, returning the patched state.
+// Only the "add", "remove" and "replace" operations are supported.
+// Replacing or removing a missing object member is not an error, so a patch
+// can be applied to a state which has already seen some of the changes.
+func applyPatch(state []byte, ops []PatchOp) ([]byte, error) {
+	doc, err := decodeState(state)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, op := range ops {
+		var value interface{}
+
+		switch op.Op {
+		case "add", "replace":
+			value, err = decodeState(op.Value)
+			if err != nil {
+				return nil, fmt.Errorf("Patch %s %s value: %w",
+					op.Op, op.Path, err)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("Patch op %s not supported", op.Op)
+		}
+
+		doc, err = applyOp(doc, op.Op, op.Path, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+func applyOp(doc interface{}, op, path string, value interface{}) (interface{}, error) {
+	if path == "" {
+		if op == "remove" {
+			return nil, nil
+		}
+		return value, nil
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("Patch path %s invalid", path)
+	}
+
+	tokens := strings.Split(path[1:], "/")
+	last := len(tokens) - 1
+
+	// Walk down to the parent of the target, remembering how to
+	// re-attach the parent should it change (arrays do when they grow or
+	// shrink)
+	parent := doc
+	attach := func(v interface{}) { doc = v }
+
+	for _, token := range tokens[:last] {
+		key := tokenUnescaper.Replace(token)
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			parent = v[key]
+			attach = func(n interface{}) { v[key] = n }
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("Patch path %s invalid", path)
+			}
+			parent = v[i]
+			attach = func(n interface{}) { v[i] = n }
+		default:
+			return nil, fmt.Errorf("Patch path %s not found", path)
+		}
+	}
+
+	token := tokenUnescaper.Replace(tokens[last])
+
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		if op == "remove" {
+			delete(v, token)
+		} else {
+			v[token] = value
+		}
+	case []interface{}:
+		i := len(v)
+		if token != "-" || op != "add" {
+			var err error
+			i, err = strconv.Atoi(token)
+			if err != nil || i < 0 || i > len(v) ||
+				(i == len(v) && op != "add") {
+				return nil, fmt.Errorf("Patch path %s invalid", path)
+			}
+		}
+		switch op {
+		case "add":
+			v = append(v[:i], append([]interface{}{value}, v[i:]...)...)
+		case "remove":
+			v = append(v[:i], v[i+1:]...)
+		case "replace":
+			v[i] = value
+		}
+		attach(v)
+	default:
+		return nil, fmt.Errorf("Patch path %s not found", path)
+	}
+
+	return doc, nil
+}
+
+// Apply a StatePatch received from Thing to our copy of Thing's state.  The
+// patched state is passed to Subscribers() as a ReplyState, and the
+// StatePatch is broadcast on to browsers.  If the patch doesn't apply, the
+// full state is requested from Thing instead.
+func (t *Thing) portPatch(pkt *Packet) {
+	var patch MsgStatePatch
+
+	if t.portState != nil {
+		pkt.Unmarshal(&patch)
+		state, err := applyPatch(t.portState, patch.Patch)
+		if err == nil {
+			t.portState = state
+			t.store.primeState(state)
+			t.bus.receive(&Packet{bus: t.bus, src: pkt.src, msg: state})
+			pkt.Broadcast()
+			return
+		}
+		t.log.printf("Applying StatePatch failed: %s", err)
+	}
+
+	msg := Msg{Msg: GetState}
+	pkt.src.Send(newPacket(t.bus, nil, &msg))
+}
@@ -0,0 +1,146 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type patchState struct {
+	Msg    string
+	Temp   int
+	States [4]bool
+	Ids    []string
+	Sub    map[string]float64
+}
+
+func TestStateDiff(t *testing.T) {
+	var diff StateDiff
+
+	states := []patchState{
+		{Msg: ReplyState, Temp: 70},
+		{Msg: ReplyState, Temp: 71, States: [4]bool{false, true}},
+		{Msg: ReplyState, Temp: 71, States: [4]bool{false, true},
+			Ids: []string{"a", "b"}, Sub: map[string]float64{"x/y": 1.5}},
+		{Msg: ReplyState, Temp: 72, Ids: []string{"a"},
+			Sub: map[string]float64{"~z": 2}},
+	}
+
+	base, _ := json.Marshal(&states[0])
+
+	for i, state := range states {
+		patch := diff.Patch(&state)
+		if patch == nil {
+			t.Fatalf("State %d: no patch", i)
+		}
+
+		got, err := applyPatch(base, patch.Patch)
+		if err != nil {
+			t.Fatalf("State %d: apply failed: %s", i, err)
+		}
+
+		var gotState patchState
+		json.Unmarshal(got, &gotState)
+		if !reflect.DeepEqual(gotState, state) {
+			t.Errorf("State %d: got %s, want %+v", i, got, state)
+		}
+		base = got
+	}
+
+	if patch := diff.Patch(&states[len(states)-1]); patch != nil {
+		t.Errorf("Unchanged state got patch %+v", patch)
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	tests := []struct{ doc, patch, want string }{
+		{`{"a":1}`, `[{"op":"replace","path":"/a","value":2}]`, `{"a":2}`},
+		{`{"a":1}`, `[{"op":"add","path":"/b","value":[1]}]`, `{"a":1,"b":[1]}`},
+		{`{"a":1}`, `[{"op":"remove","path":"/a"}]`, `{}`},
+		{`{"a":[1,2]}`, `[{"op":"add","path":"/a/1","value":3}]`, `{"a":[1,3,2]}`},
+		{`{"a":[1,2]}`, `[{"op":"add","path":"/a/-","value":3}]`, `{"a":[1,2,3]}`},
+		{`{"a":[1,2]}`, `[{"op":"remove","path":"/a/0"}]`, `{"a":[2]}`},
+		{`{"a/b":{"c~d":1}}`, `[{"op":"replace","path":"/a~1b/c~0d","value":0.5}]`, `{"a/b":{"c~d":0.5}}`},
+		{`{"a":1}`, `[{"op":"replace","path":"","value":{"b":2}}]`, `{"b":2}`},
+	}
+
+	for _, test := range tests {
+		var ops []PatchOp
+		json.Unmarshal([]byte(test.patch), &ops)
+		got, err := applyPatch([]byte(test.doc), ops)
+		if err != nil {
+			t.Errorf("applyPatch(%s, %s) failed: %s", test.doc,
+				test.patch, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("applyPatch(%s, %s) = %s, want %s", test.doc,
+				test.patch, got, test.want)
+		}
+	}
+
+	bad := []string{
+		`[{"op":"move","path":"/a","from":"/b"}]`,
+		`[{"op":"replace","path":"/x/y","value":1}]`,
+		`[{"op":"remove","path":"/a/5"}]`,
+	}
+
+	for _, patch := range bad {
+		var ops []PatchOp
+		json.Unmarshal([]byte(patch), &ops)
+		if _, err := applyPatch([]byte(`{"a":[1]}`), ops); err == nil {
+			t.Errorf("applyPatch(%s) should have failed", patch)
+		}
+	}
+}
+
+type saver struct {
+	saved chan patchState
+}
+
+func (s *saver) saveState(p *Packet) {
+	var state patchState
+	p.Unmarshal(&state)
+	s.saved <- state
+}
+
+func (s *saver) Subscribers() Subscribers {
+	return Subscribers{
+		ReplyState: s.saveState,
+	}
+}
+
+func (s *saver) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+func TestPortPatch(t *testing.T) {
+	s := &saver{saved: make(chan patchState, 1)}
+	thing := NewThing(s)
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+
+	state := patchState{Msg: ReplyState, Temp: 70}
+	thing.portState, _ = json.Marshal(&state)
+
+	var diff StateDiff
+	diff.Patch(&state)
+	state.Temp = 75
+	patch := diff.Patch(&state)
+
+	thing.portPatch(thing.NewPacket(patch))
+
+	got := <-s.saved
+	if !reflect.DeepEqual(got, state) {
+		t.Errorf("Saved state %+v, want %+v", got, state)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+)
+
+// A Socket is a socket implemented outside of merle, plugged into Thing's
+// bus with thing.Plugin().  The merletest package's fake sockets are
+// Sockets.
+type Socket interface {
+	// Name of the socket, as seen by p.SrcName()
+	Name() string
+	// Thing Id of the other end of the socket, as seen by p.Src()
+	Src() string
+	// Send Packet to the other end of the socket.  The Packet is the
+	// socket's own copy.
+	Send(p *Packet) error
+}
+
+// plugSocket adapts a Socket to the bus
+type plugSocket struct {
+	Socket
+	flags uint32
+}
+
+func (s *plugSocket) Send(p *Packet) error {
+	return s.Socket.Send(p.clone(p.bus, p.src))
+}
+
+func (s *plugSocket) Close() {
+}
+
+func (s *plugSocket) Flags() uint32 {
+	return s.flags
+}
+
+func (s *plugSocket) SetFlags(flags uint32) {
+	s.flags = flags
+}
+
+// A Plug is a Socket plugged into Thing's bus
+type Plug struct {
+	thing *Thing
+	sock  *plugSocket
+	port  bool // plugged in with PluginThing()
+}
+
+// Plugin plugs sock into Thing's bus.  Thing must be built or running.
+// Messages Thing's bus sends to sock are handed to sock.Send(); messages
+// received on sock are put on Thing's bus with plug.Receive().  Like any
+// other socket, sock gets broadcasts once it has done the GetState/ReplyState
+// handshake.
+func (t *Thing) Plugin(sock Socket) (*Plug, error) {
+	if t.bus == nil {
+		return nil, fmt.Errorf("Thing not built")
+	}
+
+	p := &Plug{thing: t, sock: &plugSocket{Socket: sock}}
+	t.bus.plugin(p.sock)
+
+	return p, nil
+}
+
+// PluginThing plugs sock into Thing Prime's bus as Prime's connection to the
+// real Thing, as if the real Thing attached on Prime's port.  Messages
+// received on the plug are handled the way Prime handles messages from the
+// real Thing: StatePatches are applied to Prime's copy of Thing's state, and
+// a ReplyState is saved as Prime's copy (see ThingConfig.StateDir) and brings
+// Thing online.  Unplugging the plug takes Thing offline.
+func (t *Thing) PluginThing(sock Socket) (*Plug, error) {
+	if !t.isPrime {
+		return nil, fmt.Errorf("Thing not Thing Prime")
+	}
+
+	p, err := t.Plugin(sock)
+	if err != nil {
+		return nil, err
+	}
+
+	p.port = true
+	t.primeSock = p.sock
+	t.portState = nil
+
+	return p, nil
+}
+
+// Receive message msg on the plug's socket, as if the other end of the socket
+// sent msg.  The message is matched against Thing's Subscribers().
+func (p *Plug) Receive(msg interface{}) {
+	pkt := newPacket(p.thing.bus, p.sock, msg)
+	if p.port {
+		p.thing.portReceive(pkt, p.thing.primeReady)
+		return
+	}
+	p.thing.bus.receive(pkt)
+}
+
+// Unplug the socket from Thing's bus
+func (p *Plug) Unplug() {
+	p.thing.bus.unplug(p.sock)
+	if p.port {
+		p.thing.primeCleanup(p.thing)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Poller polls a sensor every Interval and broadcasts the readings, but
+// only when the readings change.  Read() stores the readings in State, a
+// pointer to a struct, and Poller compares State's exported fields with the
+// last readings broadcast.  If any field changed (by more than the field's
+// Deadband, for numeric fields), State is broadcast as message Msg.
+//
+// Poller takes the Locker around Read() and the broadcast's marshaling, so
+// the Thinger's other handlers (GetState, say) see consistent readings.
+// Read() is called with the Locker held and should not take it again.
+//
+//	func (b *bmp180) read() error {
+//		temp, err := b.driver.Temperature()
+//		b.Temperature = int(math.Round(float64(temp)))
+//		return err
+//	}
+//
+//	func (b *bmp180) run(p *merle.Packet) {
+//		b.poller = &merle.Poller{
+//			Locker:    b,
+//			State:     b,
+//			Read:      b.read,
+//			Interval:  time.Second,
+//			Deadband:  map[string]float64{"Temperature": 1},
+//			Heartbeat: time.Minute,
+//		}
+//		b.poller.Run(p)
+//	}
+//
+// Run is a CmdRun handler; Run polls until Stop().
+type Poller struct {
+	// Lock guarding State; usually the Thinger.  Optional.
+	Locker sync.Locker
+	// Pointer to the struct Read() stores readings in.  State's exported
+	// fields are the readings.  If State has a string field named Msg,
+	// it's set to Msg before each broadcast.  Embedded fields and
+	// fields tagged `json:"-"` are ignored.
+	State interface{}
+	// Read the sensor, storing the readings in State
+	Read func() error
+	// How often to Read.  The default is one second.
+	Interval time.Duration
+	// Change needed in a numeric field, from the last value broadcast,
+	// to broadcast again.  Fields not listed are broadcast on any change.
+	Deadband map[string]float64
+	// Broadcast the readings, changed or not, if nothing was broadcast
+	// for this long.  The default is zero: never.
+	Heartbeat time.Duration
+	// Message broadcast.  The default is "Update".
+	Msg string
+
+	last     map[string]interface{}
+	lastSent time.Time
+	once     sync.Once
+	done     chan bool
+	stopOnce sync.Once
+}
+
+func (pl *Poller) init() {
+	pl.once.Do(func() {
+		pl.done = make(chan bool)
+	})
+}
+
+func (pl *Poller) lock() {
+	if pl.Locker != nil {
+		pl.Locker.Lock()
+	}
+}
+
+func (pl *Poller) unlock() {
+	if pl.Locker != nil {
+		pl.Locker.Unlock()
+	}
+}
+
+// Snapshot State's readings.  Numeric readings are kept as float64, for the
+// deadband check; everything else as JSON, so slices and maps are copied.
+func (pl *Poller) snapshot() map[string]interface{} {
+	v := reflect.ValueOf(pl.State)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	snap := make(map[string]interface{})
+	typ := v.Type()
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" || field.Anonymous || field.Name == "Msg" ||
+			strings.Split(field.Tag.Get("json"), ",")[0] == "-" {
+			continue
+		}
+
+		value := v.Field(i)
+		switch value.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+			reflect.Int64:
+			snap[field.Name] = float64(value.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+			reflect.Uint64:
+			snap[field.Name] = float64(value.Uint())
+		case reflect.Float32, reflect.Float64:
+			snap[field.Name] = value.Float()
+		default:
+			data, _ := jsonMarshal(value.Interface())
+			snap[field.Name] = string(data)
+		}
+	}
+
+	return snap
+}
+
+// Have the readings changed since the last broadcast?
+func (pl *Poller) changed(snap map[string]interface{}) bool {
+	if pl.last == nil {
+		return true
+	}
+
+	for name, value := range snap {
+		last := pl.last[name]
+		if f, ok := value.(float64); ok {
+			lastf, _ := last.(float64)
+			if f != lastf && math.Abs(f-lastf) >= pl.Deadband[name] {
+				return true
+			}
+		} else if value != last {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Poll once: Read, and broadcast the readings if changed
+func (pl *Poller) poll(t *Thing) {
+	var update *Packet
+
+	pl.lock()
+	err := pl.Read()
+	if err == nil {
+		snap := pl.snapshot()
+		heartbeat := pl.Heartbeat > 0 &&
+			time.Since(pl.lastSent) >= pl.Heartbeat
+		if pl.changed(snap) || heartbeat {
+			msg := pl.Msg
+			if msg == "" {
+				msg = "Update"
+			}
+			setMsg(pl.State, msg)
+			update = t.NewPacket(pl.State)
+			pl.last = snap
+			pl.lastSent = time.Now()
+		}
+	}
+	pl.unlock()
+
+	if err != nil {
+		t.log.printf("Poller read failed: %s", err)
+		return
+	}
+
+	if update != nil {
+		update.Broadcast()
+	}
+}
+
+// Run polls until Stop().  Run is a CmdRun handler.
+//
+//	return merle.Subscribers{
+//		...
+//		merle.CmdRun: poller.Run,
+//	}
+func (pl *Poller) Run(p *Packet) {
+	pl.init()
+
+	interval := pl.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	thing := p.Thing()
+
+	for {
+		pl.poll(thing)
+
+		select {
+		case <-pl.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop polling; Run returns.  It's safe to call Stop() more than once.
+func (pl *Poller) Stop() {
+	pl.init()
+	pl.stopOnce.Do(func() { close(pl.done) })
+}
@@ -0,0 +1,175 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// catcher is a socket catching broadcasts
+type catcher struct {
+	sysSocket
+	pkts chan string
+}
+
+func (c *catcher) Send(p *Packet) error {
+	c.pkts <- p.String()
+	return nil
+}
+
+func newCatcher(thing *Thing) *catcher {
+	c := &catcher{sysSocket: sysSocket{name: "catcher"},
+		pkts: make(chan string, 100)}
+	c.SetFlags(sock_flag_bcast)
+	thing.bus.plugin(c)
+	return c
+}
+
+func (c *catcher) caught() (pkts []string) {
+	for {
+		select {
+		case p := <-c.pkts:
+			pkts = append(pkts, p)
+		default:
+			return
+		}
+	}
+}
+
+type sensor struct {
+	sync.Mutex
+	Msg    string
+	Temp   float64
+	Label  string
+	Ids    []int
+	Secret string `json:"-"`
+	count  int
+}
+
+func TestPoller(t *testing.T) {
+	thing := NewThing(&empty{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+	c := newCatcher(thing)
+
+	s := &sensor{}
+	ids := []int{1}
+	readings := []struct {
+		temp   float64
+		label  string
+		secret string
+		ids    int
+	}{
+		{70, "a", "x", 1},   // first reading; broadcast
+		{70.2, "a", "y", 1}, // within deadband; secret ignored
+		{70.4, "a", "x", 1}, // within deadband
+		{70.6, "a", "x", 1}, // 0.6 from last broadcast; broadcast
+		{70.6, "b", "x", 1}, // label changed; broadcast
+		{70.6, "b", "x", 2}, // slice element changed; broadcast
+		{70.6, "b", "x", 2}, // no change
+	}
+
+	pl := &Poller{
+		Locker: s,
+		State:  s,
+		Read: func() error {
+			r := readings[s.count]
+			s.count++
+			s.Temp, s.Label, s.Secret = r.temp, r.label, r.secret
+			ids[0] = r.ids
+			s.Ids = ids
+			return nil
+		},
+		Deadband: map[string]float64{"Temp": 0.5},
+	}
+
+	for range readings {
+		pl.poll(thing)
+	}
+
+	want := []string{
+		`{"Msg":"Update","Temp":70,"Label":"a","Ids":[1]}`,
+		`{"Msg":"Update","Temp":70.6,"Label":"a","Ids":[1]}`,
+		`{"Msg":"Update","Temp":70.6,"Label":"b","Ids":[1]}`,
+		`{"Msg":"Update","Temp":70.6,"Label":"b","Ids":[2]}`,
+	}
+	got := c.caught()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Broadcast %v, want %v", got, want)
+	}
+}
+
+func TestPollerHeartbeat(t *testing.T) {
+	thing := NewThing(&empty{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+	c := newCatcher(thing)
+
+	s := &sensor{}
+	pl := &Poller{
+		State:     s,
+		Read:      func() error { return nil },
+		Heartbeat: time.Nanosecond,
+		Msg:       "Heartbeat",
+	}
+
+	pl.poll(thing)
+	pl.poll(thing)
+
+	if got := c.caught(); len(got) != 2 {
+		t.Errorf("Broadcast %v, want 2 heartbeats", got)
+	}
+
+	// Errors skip the broadcast
+	pl.Read = func() error { return fmt.Errorf("Sensor gone") }
+	pl.poll(thing)
+	if got := c.caught(); len(got) != 0 {
+		t.Errorf("Broadcast %v after read error", got)
+	}
+}
+
+func TestPollerStop(t *testing.T) {
+	thing := NewThing(&empty{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+
+	var reads int
+	pl := &Poller{
+		State:    &sensor{},
+		Read:     func() error { reads++; return nil },
+		Interval: time.Millisecond,
+	}
+
+	ran := make(chan bool)
+	go func() {
+		pl.Run(thing.NewPacket(&Msg{Msg: CmdRun}))
+		close(ran)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	pl.Stop()
+	pl.Stop()
+
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatalf("Run didn't return after Stop")
+	}
+	if reads == 0 {
+		t.Errorf("Run didn't poll")
+	}
+}
@@ -22,15 +22,56 @@ import (
 
 type portAttachCb func(*port, *MsgIdentity) error
 
+// Errors replying to a port request.  Both mean try again later.
+var (
+	errPortBusy = errors.New("Port is busy")
+	errNoPorts  = errors.New("No ports available")
+)
+
+// Reply to a port request from a Thing's tunnel, as JSON.  Either Port is the
+// port for Thing's tunnel, or Error is the reason there's no port.
+type portReply struct {
+	Port  uint   `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// portReply Error codes
+var portErrors = map[string]error{
+	"busy":     errPortBusy,
+	"no ports": errNoPorts,
+}
+
+func newPortReply(port uint, err error) portReply {
+	for code, e := range portErrors {
+		if err == e {
+			return portReply{Error: code}
+		}
+	}
+	return portReply{Port: port}
+}
+
+func (r *portReply) result() (uint, error) {
+	if r.Error == "" {
+		return r.Port, nil
+	}
+	if err, ok := portErrors[r.Error]; ok {
+		return 0, err
+	}
+	return 0, fmt.Errorf("Port request failed: %s", r.Error)
+}
+
 type port struct {
 	thing *Thing
 	sync.Mutex
 	port              uint
+	name              string
 	tunnelTrying      bool
 	tunnelTryingUntil time.Time
 	tunnelConnected   bool
 	ws                *websocket.Conn
+	codec             Codec
 	done              chan bool
+	stopped           bool
 	attachCb          portAttachCb
 }
 
@@ -67,11 +108,6 @@ func newPorts(thing *Thing, begin, end uint, attachCb portAttachCb) *ports {
 	}
 }
 
-func (p *port) readMessage() (msg []byte, err error) {
-	_, msg, err = p.ws.ReadMessage()
-	return msg, err
-}
-
 func (p *port) writeMessage(msg []byte) {
 	p.ws.WriteMessage(websocket.TextMessage, msg)
 }
@@ -89,7 +125,8 @@ func (p *port) wsOpen() error {
 }
 
 func (p *port) wsIdentity() error {
-	msg := Msg{Msg: GetIdentity}
+	msg := MsgGetIdentity{Msg: GetIdentity,
+		Codecs: codecNames(p.thing.Cfg.Codec)}
 	p.thing.log.printf("Sending: %v", msg)
 	return p.ws.WriteJSON(&msg)
 }
@@ -123,9 +160,12 @@ func (p *port) wsClose() {
 		return
 	}
 	// TODO: is this doing anything?  Maybe p.ws.Close() is sufficient.
-	p.ws.WriteMessage(websocket.CloseMessage,
+	// (WriteControl is safe to call concurrently with the websocket's
+	// writer go func).
+	p.ws.WriteControl(websocket.CloseMessage,
 		websocket.FormatCloseMessage(
-			websocket.CloseNormalClosure, ""))
+			websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
 	p.ws.Close()
 	p.ws = nil
 }
@@ -146,9 +186,68 @@ func (p *port) wsConnect() (resp *MsgIdentity, err error) {
 		return nil, errors.Wrap(err, "Didn't reply with Identity in a reasonable time")
 	}
 
+	p.codec, err = identityCodec(resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "Identity codec")
+	}
+
 	return resp, nil
 }
 
+// Attach a Thing which dialed in on its link (see link), rather than coming
+// in on a tunnel.  The link is always JSON, so no codecs are offered.
+func (p *port) attachLink() {
+	defer p.wsClose()
+
+	msg := MsgGetIdentity{Msg: GetIdentity}
+	p.thing.log.printf("Sending: %v", msg)
+	if err := p.ws.WriteJSON(&msg); err != nil {
+		p.thing.log.printf("Port[%s] send request for Identity failed: %s",
+			p.name, err)
+		return
+	}
+
+	resp, err := p.wsReplyIdentity()
+	if err != nil {
+		p.thing.log.printf("Port[%s] didn't reply with Identity: %s",
+			p.name, err)
+		return
+	}
+
+	p.linkKeepalives()
+
+	err = p.attachCb(p, resp)
+	if err != nil {
+		p.thing.log.printf("Port[%s] attach failed: %s", p.name, err)
+	}
+}
+
+// Thing pings on its link every keepalive (see link).  Drop the link if the
+// pings stop, rather than keep a half-open link, and the Thing, online.
+func (p *port) linkKeepalives() {
+	var ws = p.ws
+	var wait = p.thing.web.linkKeepalive * linkKeepaliveMax
+
+	ws.SetReadDeadline(time.Now().Add(wait))
+	ws.SetPingHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(wait))
+		err := ws.WriteControl(websocket.PongMessage, []byte(data),
+			time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+}
+
+// Name of the socket plugged into the bus for the port
+func (p *port) sockName() string {
+	if p.name != "" {
+		return p.name
+	}
+	return fmt.Sprintf("port:%d", p.port)
+}
+
 func (p *port) wsDisconnect() {
 	p.wsClose()
 	p.Lock()
@@ -243,9 +342,12 @@ func (p *port) scan() error {
 
 func (p *port) run() error {
 	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
 	for {
 		select {
+		case <-p.done:
+			return nil
 		case <-ticker.C:
 			if err := p.scan(); err != nil {
 				p.thing.log.println("Scanning port error:", err)
@@ -253,8 +355,19 @@ func (p *port) run() error {
 			}
 		}
 	}
+}
 
-	return nil
+// Stop scanning port and close any attached websocket
+func (p *port) stop() {
+	p.Lock()
+	defer p.Unlock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.done)
+	}
+	if p.ws != nil {
+		p.ws.Close()
+	}
 }
 
 func (p *ports) nextPort() (port *port) {
@@ -285,7 +398,7 @@ func (p *ports) nextPort() (port *port) {
 	return nil
 }
 
-func (p *ports) getPort(id string) int {
+func (p *ports) getPort(id string) (uint, error) {
 	var port *port
 	var ok bool
 
@@ -293,18 +406,18 @@ func (p *ports) getPort(id string) int {
 		port.Lock()
 		if port.tunnelConnected {
 			port.Unlock()
-			return -2 // Port busy; try later
+			return 0, errPortBusy
 		}
 		port.Unlock()
 	} else {
 		port = p.nextPort()
 		if port == nil {
-			return -1 // No more ports; try later
+			return 0, errNoPorts
 		}
 		p.portMap[id] = port
 	}
 
-	return int(port.port)
+	return port.port, nil
 }
 
 func (p *ports) init() error {
@@ -376,6 +489,19 @@ func (p *ports) start() error {
 }
 
 func (p *ports) stop() {
+	if p.ticker == nil {
+		// Never started
+		return
+	}
 	p.ticker.Stop()
-	p.done <- true
+	close(p.done)
+
+	for i := uint(0); i < p.num; i++ {
+		port := &p.ports[i]
+		port.Lock()
+		if port.ws != nil {
+			port.ws.Close()
+		}
+		port.Unlock()
+	}
 }
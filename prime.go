@@ -7,25 +7,61 @@
 
 package merle
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Is Thing attached to Thing Prime, on the prime port's tunnel or on its link
+// (see primeLinkAttach)?  Call with primePort locked.
+func (t *Thing) primeBusy() bool {
+	return t.primePort.tunnelConnected || t.primeLinked || t.isOnline()
+}
 
-func (t *Thing) getPrimePort(id string) string {
+func (t *Thing) getPrimePort(id string) (uint, error) {
 	t.primePort.Lock()
 	defer t.primePort.Unlock()
 
-	if t.primePort.tunnelConnected {
-		return "port busy"
+	if t.primeBusy() {
+		return 0, errPortBusy
 	}
 
 	if t.primeId != "" && t.primeId != id {
-		return "no ports available"
+		return 0, errNoPorts
 	}
 
-	return fmt.Sprintf("%d", t.primePort.port)
+	return t.primePort.port, nil
+}
+
+// Put a message received from Thing on the port on the bus.  A StatePatch is
+// applied to our copy of Thing's state (see portPatch), and a ReplyState is
+// saved as our copy, before going on the bus.  ready is called once Thing's
+// ReplyState is on the bus.
+func (t *Thing) portReceive(pkt *Packet, ready func(*Thing)) {
+	var msg Msg
+
+	pkt.Unmarshal(&msg)
+
+	switch msg.Msg {
+	case StatePatch:
+		t.portPatch(pkt)
+		return
+	case ReplyState:
+		// Save a copy to apply StatePatches to
+		t.portState = pkt.msg
+		t.store.primeState(t.portState)
+	}
+
+	t.bus.receive(pkt)
+
+	if msg.Msg == ReplyState {
+		ready(t)
+	}
 }
 
 func (t *Thing) runOnPort(p *port, ready func(*Thing), cleanup func(*Thing)) error {
-	var name = fmt.Sprintf("port:%d", p.port)
+	var name = p.sockName()
 	var sock = newWebSocket(t, name, p.ws)
 	var pkt = newPacket(t.bus, sock, nil)
 	var msg = Msg{Msg: GetState}
@@ -33,7 +69,12 @@ func (t *Thing) runOnPort(p *port, ready func(*Thing), cleanup func(*Thing)) err
 
 	t.log.printf("Websocket opened [%s]", name)
 
+	if p.codec != nil {
+		sock.setCodec(p.codec, true)
+	}
+
 	t.primeSock = sock
+	t.portState = nil
 	t.bus.plugin(sock)
 
 	// Send GetState msg to Thing
@@ -43,22 +84,17 @@ func (t *Thing) runOnPort(p *port, ready func(*Thing), cleanup func(*Thing)) err
 		// new pkt for each rcv
 		var pkt = newPacket(t.bus, sock, nil)
 
-		pkt.msg, err = p.readMessage()
+		pkt.msg, err = sock.read()
 		if err != nil {
 			t.log.printf("Websocket closed [%s]", name)
 			break
 		}
 
-		pkt.Unmarshal(&msg)
-
-		t.bus.receive(pkt)
-
-		if msg.Msg == ReplyState {
-			ready(t)
-		}
+		t.portReceive(pkt, ready)
 	}
 
 	t.bus.unplug(sock)
+	sock.Close()
 
 	cleanup(t)
 
@@ -66,18 +102,18 @@ func (t *Thing) runOnPort(p *port, ready func(*Thing), cleanup func(*Thing)) err
 }
 
 func (t *Thing) sendStatus() {
-	msg := MsgEventStatus{Msg: EventStatus, Id: t.id, Online: t.online}
+	msg := MsgEventStatus{Msg: EventStatus, Id: t.id, Online: t.isOnline()}
 	newPacket(t.bus, t.primeSock, &msg).Broadcast()
 }
 
 func (t *Thing) primeReady(self *Thing) {
-	t.online = true
+	t.setOnline(true)
 	t.web.public.start()
 	t.sendStatus()
 }
 
 func (t *Thing) primeCleanup(self *Thing) {
-	t.online = false
+	t.setOnline(false)
 	t.sendStatus()
 }
 
@@ -90,7 +126,7 @@ func (t *Thing) primeAttach(p *port, msg *MsgIdentity) error {
 	t.id = msg.Id
 	t.model = msg.Model
 	t.name = msg.Name
-	t.online = msg.Online
+	t.setOnline(msg.Online)
 	t.startupTime = msg.StartupTime
 	t.primeId = t.id
 
@@ -102,7 +138,86 @@ func (t *Thing) primeAttach(p *port, msg *MsgIdentity) error {
 	return t.runOnPort(p, t.primeReady, t.primeCleanup)
 }
 
-func (t *Thing) primeRun() error {
+// Attach Thing which dialed in on its link (see link), rather than coming in
+// on the Prime port
+func (t *Thing) primeLinkAttach(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		t.log.println("Link upgrader error:", err)
+		return
+	}
+
+	p := newPort(t, 0, t.primeLinkAttachCb)
+	p.name = "link:" + r.RemoteAddr
+	p.ws = ws
+
+	p.attachLink()
+}
+
+func (t *Thing) primeLinkAttachCb(p *port, msg *MsgIdentity) error {
+	t.primePort.Lock()
+
+	if t.primeBusy() {
+		t.primePort.Unlock()
+		return fmt.Errorf("Thing Prime already attached")
+	}
+
+	if t.primeId != "" && t.primeId != msg.Id {
+		t.primePort.Unlock()
+		return fmt.Errorf("Thing Prime is for Thing %s, not %s",
+			t.primeId, msg.Id)
+	}
+
+	t.primeLinked = true
+	t.primePort.Unlock()
+
+	defer func() {
+		t.primePort.Lock()
+		t.primeLinked = false
+		t.primePort.Unlock()
+	}()
+
+	return t.primeAttach(p, msg)
+}
+
+func (t *Thing) primeRun(ctx context.Context) error {
+	t.primeRestore()
+	t.store.start()
+
 	t.web.private.start()
-	return t.primePort.run()
+
+	// Children dial in on the public HTTPS server to attach, so start it
+	// now rather than when Thing attaches
+	if t.Cfg.AttachToken != "" {
+		t.web.public.start()
+	}
+
+	ran := make(chan error, 1)
+	go func() {
+		ran <- t.primePort.run()
+	}()
+
+	var err error
+
+	select {
+	case err = <-ran:
+	case <-ctx.Done():
+		t.log.println("Stopping; context done")
+	case <-t.done:
+		t.log.println("Stopping")
+	}
+
+	t.primePort.stop()
+	t.store.stop()
+
+	t.web.public.stop()
+	t.web.private.stop()
+
+	t.bus.close()
+
+	if t.recorder != nil {
+		t.recorder.Close()
+	}
+
+	return err
 }
@@ -0,0 +1,219 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// QueuePolicy is what to do with a Packet when a socket queue is full.  See
+// ThingConfig.AsyncDispatch.
+type QueuePolicy int
+
+const (
+	// Block the sender until there is room in the queue
+	QueueBlock QueuePolicy = iota
+	// Drop the Packet being queued
+	QueueDropNewest
+	// Drop the oldest Packet in the queue to make room
+	QueueDropOldest
+)
+
+func (q QueuePolicy) String() string {
+	switch q {
+	case QueueBlock:
+		return "block"
+	case QueueDropNewest:
+		return "drop-newest"
+	case QueueDropOldest:
+		return "drop-oldest"
+	}
+	return "unknown"
+}
+
+// QueueStats reports the state of a socket's inbound and outbound queues.
+type QueueStats struct {
+	// Socket name
+	Name string
+	// Packets waiting in the inbound queue, to be dispatched to
+	// Subscribers()
+	InDepth int
+	// Packets waiting in the outbound queue, to be sent on the socket
+	OutDepth int
+	// Packets dropped because the inbound queue was full
+	InDropped uint64
+	// Packets dropped because the outbound queue was full
+	OutDropped uint64
+}
+
+// A pktQueue is a bounded queue of Packets, drained by its own go func
+type pktQueue struct {
+	dropped  uint64 // first, for 64-bit alignment of atomic ops
+	ch       chan *Packet
+	done     chan bool
+	stopOnce sync.Once
+	policy   QueuePolicy
+}
+
+func newPktQueue(depth uint, policy QueuePolicy, handle func(*Packet)) *pktQueue {
+	q := &pktQueue{
+		ch:     make(chan *Packet, depth),
+		done:   make(chan bool),
+		policy: policy,
+	}
+
+	go func() {
+		for {
+			select {
+			case <-q.done:
+				return
+			case p := <-q.ch:
+				handle(p)
+			}
+		}
+	}()
+
+	return q
+}
+
+// Put Packet on queue.  Returns false if a Packet was dropped.
+func (q *pktQueue) put(p *Packet) bool {
+	switch q.policy {
+	case QueueDropNewest:
+		select {
+		case q.ch <- p:
+			return true
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+			return false
+		}
+	case QueueDropOldest:
+		ok := true
+		for {
+			select {
+			case q.ch <- p:
+				return ok
+			default:
+			}
+			select {
+			case <-q.ch:
+				atomic.AddUint64(&q.dropped, 1)
+				ok = false
+			default:
+			}
+		}
+	default:
+		select {
+		case q.ch <- p:
+		case <-q.done:
+		}
+		return true
+	}
+}
+
+// Stop the queue.  Any Packets still queued are dropped.
+func (q *pktQueue) stop() {
+	q.stopOnce.Do(func() { close(q.done) })
+}
+
+// A sockQueue is a socket's inbound and outbound queues
+type sockQueue struct {
+	in  *pktQueue
+	out *pktQueue
+}
+
+func newSockQueue(b *bus, s socketer) *sockQueue {
+	depth := b.thing.Cfg.QueueDepth
+	policy := b.thing.Cfg.QueuePolicy
+
+	return &sockQueue{
+		in: newPktQueue(depth, policy, func(p *Packet) {
+			b.intercept(p, DirReceive, b.doReceive)
+		}),
+		out: newPktQueue(depth, policy, func(p *Packet) {
+			s.Send(p)
+		}),
+	}
+}
+
+func (q *sockQueue) stop() {
+	q.in.stop()
+	q.out.stop()
+}
+
+// Socket's queues, or nil if not dispatching asynchronously
+func (b *bus) sockQueue(sock socketer) *sockQueue {
+	if !b.async || sock == nil {
+		return nil
+	}
+
+	b.sockLock.RLock()
+	defer b.sockLock.RUnlock()
+
+	return b.sockets[sock]
+}
+
+// Queue Packet received from socket.  Returns false if Packet should be
+// dispatched synchronously.
+func (b *bus) queueIn(p *Packet) bool {
+	q := b.sockQueue(p.src)
+	if q == nil {
+		return false
+	}
+
+	if !q.in.put(p) {
+		b.thing.log.printf("Inbound queue full [%s]; dropped packet",
+			p.src.Name())
+	}
+
+	return true
+}
+
+// Send Packet on socket, by way of socket's outbound queue q, if any
+func (b *bus) sockSend(sock socketer, q *sockQueue, p *Packet) error {
+	if q == nil {
+		return sock.Send(p)
+	}
+
+	// Queue a clone; the handler is free to re-Marshal p once we return
+	if !q.out.put(p.clone(p.bus, p.src)) {
+		b.thing.log.printf("Outbound queue full [%s]; dropped packet",
+			sock.Name())
+	}
+
+	return nil
+}
+
+func (b *bus) queueStats() []QueueStats {
+	var stats []QueueStats
+
+	b.sockLock.RLock()
+	defer b.sockLock.RUnlock()
+
+	for sock, q := range b.sockets {
+		if q == nil {
+			continue
+		}
+		stats = append(stats, QueueStats{
+			Name:       sock.Name(),
+			InDepth:    len(q.in.ch),
+			OutDepth:   len(q.out.ch),
+			InDropped:  atomic.LoadUint64(&q.in.dropped),
+			OutDropped: atomic.LoadUint64(&q.out.dropped),
+		})
+	}
+
+	return stats
+}
+
+// QueueStats returns the queue stats for each socket on Thing's bus.  Queue
+// stats are only available if Thing is configured with AsyncDispatch.
+func (t *Thing) QueueStats() []QueueStats {
+	if t.bus == nil {
+		return nil
+	}
+	return t.bus.queueStats()
+}
@@ -0,0 +1,174 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type blocker struct {
+	started chan bool
+	release chan bool
+	handled int32
+}
+
+func (b *blocker) block(p *Packet) {
+	if atomic.AddInt32(&b.handled, 1) == 1 {
+		close(b.started)
+	}
+	<-b.release
+}
+
+func (b *blocker) Subscribers() Subscribers {
+	return Subscribers{
+		"Block": b.block,
+	}
+}
+
+func (b *blocker) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+func TestAsyncDispatch(t *testing.T) {
+	thinger := blocker{
+		started: make(chan bool),
+		release: make(chan bool),
+	}
+
+	child := NewThing(&thinger)
+	child.Cfg.AsyncDispatch = true
+	child.Cfg.QueueDepth = 2
+	child.Cfg.QueuePolicy = QueueDropNewest
+
+	mother, _ := wire(t, NewThing(&sparse{}), child)
+
+	msg := Msg{Msg: "Block"}
+
+	// First msg is picked up by the handler, which blocks...
+	mother.SendTo("child", &msg)
+	<-thinger.started
+
+	// ...so the next two are queued and the rest dropped, without
+	// stalling the sender
+	for i := 0; i < 4; i++ {
+		mother.SendTo("child", &msg)
+	}
+
+	stats := child.QueueStats()
+	if len(stats) != 1 {
+		t.Fatalf("Got %d queue stats, want 1", len(stats))
+	}
+	if stats[0].InDepth != 2 || stats[0].InDropped != 2 {
+		t.Errorf("Got queue stats %+v, want InDepth 2, InDropped 2",
+			stats[0])
+	}
+
+	close(thinger.release)
+
+	for i := 0; i < 100 && atomic.LoadInt32(&thinger.handled) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if handled := atomic.LoadInt32(&thinger.handled); handled != 3 {
+		t.Errorf("Handled %d msgs, want 3", handled)
+	}
+}
+
+func TestQueuePolicy(t *testing.T) {
+	block := make(chan bool)
+	handle := func(p *Packet) { <-block }
+
+	q := newPktQueue(1, QueueDropOldest, handle)
+	defer q.stop()
+
+	first := &Packet{msg: []byte("first")}
+	q.put(first)
+	// Wait for handler to pick up first
+	for len(q.ch) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	q.put(&Packet{msg: []byte("second")})
+	if q.put(&Packet{msg: []byte("third")}) {
+		t.Errorf("Put on full drop-oldest queue should report drop")
+	}
+	if p := <-q.ch; p.String() != "third" {
+		t.Errorf("Got %s, want third", p)
+	}
+	if q.dropped != 1 {
+		t.Errorf("Dropped %d, want 1", q.dropped)
+	}
+
+	close(block)
+}
+
+// stalledSocket never finishes sending
+type stalledSocket struct {
+	flags   uint32
+	release chan bool
+}
+
+func (s *stalledSocket) Send(p *Packet) error {
+	<-s.release
+	return nil
+}
+
+func (s *stalledSocket) Close()                {}
+func (s *stalledSocket) Name() string          { return "stalled" }
+func (s *stalledSocket) Flags() uint32         { return s.flags }
+func (s *stalledSocket) SetFlags(flags uint32) { s.flags = flags }
+func (s *stalledSocket) Src() string           { return "stalled" }
+
+// A socket stalled with a full outbound queue mustn't hold up unplugging
+func TestQueueBlockUnplug(t *testing.T) {
+	thing := NewThing(&empty{})
+	thing.Cfg.LoggingEnabled = false
+	thing.Cfg.AsyncDispatch = true
+	thing.Cfg.QueueDepth = 1
+	thing.Cfg.QueuePolicy = QueueBlock
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+
+	sock := &stalledSocket{flags: sock_flag_bcast, release: make(chan bool)}
+	defer close(sock.release)
+	thing.bus.plugin(sock)
+
+	// First is stuck sending, second fills the queue, third blocks
+	broadcasted := make(chan bool)
+	go func() {
+		for i := 0; i < 3; i++ {
+			thing.Broadcast(&Msg{Msg: "Update"})
+		}
+		close(broadcasted)
+	}()
+
+	for i := 0; i < 100 && len(thing.bus.sockQueue(sock).out.ch) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	unplugged := make(chan bool)
+	go func() {
+		thing.bus.unplug(sock)
+		close(unplugged)
+	}()
+
+	select {
+	case <-unplugged:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Unplug blocked behind stalled socket")
+	}
+
+	select {
+	case <-broadcasted:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Broadcast still blocked after unplug")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Record is one Packet passing through a Thing's bus, as recorded by a
+// Recorder.  A recording is a file of Records, one JSON-encoded Record per
+// line (JSONL):
+//
+//	{"Time":"2022-06-01T10:00:00.5Z","Sock":"port:6001","Src":"gps01","Dir":"receive","Msg":{"Msg":"_GetState"}}
+type Record struct {
+	// When the Packet passed through the bus
+	Time time.Time
+	// Name of the Packet's source socket (p.SrcName())
+	Sock string
+	// Packet's source Thing Id (p.Src())
+	Src string
+	// Direction: "receive", "reply", "broadcast" or "send"
+	Dir string
+	// Packet message, as is.  (A malformed message is recorded as a JSON
+	// string).
+	Msg json.RawMessage
+}
+
+// A Recorder is Middleware which records every Packet passing through a
+// Thing's bus, as JSONL Records written to w.  Record a Thing's bus by
+// setting ThingConfig.RecordFile, or by adding a Recorder to the Thing's
+// Middleware:
+//
+//	rec := merle.NewRecorder(file)
+//	thing.Cfg.Middleware = []merle.Middleware{rec}
+//
+// Play a recording back with thing.Replay().
+type Recorder struct {
+	sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+	err error
+}
+
+// NewRecorder returns a Recorder writing Records to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w, enc: json.NewEncoder(w)}
+}
+
+// Intercept records Packet p and passes it on
+func (r *Recorder) Intercept(p *Packet, dir Direction, next func(*Packet)) {
+	rec := Record{
+		Time: time.Now(),
+		Sock: p.SrcName(),
+		Src:  p.Src(),
+		Dir:  dir.String(),
+		Msg:  json.RawMessage(p.msg),
+	}
+
+	if !json.Valid(p.msg) {
+		// Keep malformed messages, as a JSON string
+		rec.Msg, _ = json.Marshal(string(p.msg))
+	}
+
+	r.Lock()
+	if r.err == nil {
+		r.err = r.enc.Encode(&rec)
+	}
+	r.Unlock()
+
+	next(p)
+}
+
+// Err returns the first error writing the recording, if any
+func (r *Recorder) Err() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.err
+}
+
+// Close the recording, if the Recorder's writer is an io.Closer
+func (r *Recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if c, ok := r.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Start recording Thing's bus to Cfg.RecordFile
+func (t *Thing) startRecorder() error {
+	if t.Cfg.RecordFile == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(t.Cfg.RecordFile,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Opening record file: %w", err)
+	}
+
+	rec := NewRecorder(file)
+	t.recorder = rec
+	t.bus.use(rec)
+
+	t.log.printf("Recording bus to %s", t.Cfg.RecordFile)
+
+	return nil
+}
+
+// A replaySocket stands in for the socket a recorded Packet was received
+// on.  Replies sent to a replaySocket are dropped.
+type replaySocket struct {
+	sysSocket
+	src string
+}
+
+func (s *replaySocket) Src() string {
+	return s.src
+}
+
+// Replay feeds a recording back into Thing's Subscribers(), to reproduce
+// what Thing saw, without the devices or connections Thing had when the
+// recording was made.  Only received Packets ("receive" Records) are
+// replayed, from stand-ins for their original sockets, so p.Src() and
+// p.SrcName() are as recorded.  Replies from Subscribers() are dropped.
+// CmdRun isn't replayed, since CmdRun is the Thing's device main loop.
+//
+// If realTime is true, Records are replayed with the same timing as they
+// were recorded; otherwise, Records are replayed as fast as possible.
+//
+//	thing := merle.NewThing(gps.NewGps())
+//	thing.Cfg.Id = "gps01"
+//	f, _ := os.Open("gps01.jsonl")
+//	err := thing.Replay(f, false)
+//
+// The Thing need not be running; Replay builds the Thing, if needed, but
+// doesn't start Thing's web servers or tunnel.  A Thing built by Replay
+// doesn't record the replay to Cfg.RecordFile.
+func (t *Thing) Replay(r io.Reader, realTime bool) error {
+	if t.bus == nil {
+		t.replaying = true
+		if err := t.Build(); err != nil {
+			return err
+		}
+	}
+
+	socks := make(map[string]*replaySocket)
+
+	var last time.Time
+	var line int
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		var rec Record
+
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("Replay line %d: %w", line, err)
+		}
+
+		if rec.Dir != DirReceive.String() {
+			continue
+		}
+
+		var msg Msg
+		if err := jsonUnmarshal(rec.Msg, &msg); err != nil ||
+			msg.Msg == CmdRun {
+			continue
+		}
+
+		if realTime && !last.IsZero() && rec.Time.After(last) {
+			time.Sleep(rec.Time.Sub(last))
+		}
+		last = rec.Time
+
+		sock, ok := socks[rec.Sock]
+		if !ok {
+			sock = &replaySocket{
+				sysSocket: sysSocket{name: rec.Sock},
+				src:       rec.Src,
+			}
+			socks[rec.Sock] = sock
+		}
+
+		t.bus.receive(&Packet{bus: t.bus, src: sock, msg: rec.Msg})
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,84 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bus.jsonl")
+
+	k := &keeper{}
+	thing := NewThing(k)
+	thing.Cfg.Id = testId
+	thing.Cfg.RecordFile = file
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+
+	thing.InjectFrom("browser", &Msg{Msg: "Inc"})
+	thing.InjectFrom("browser", &Msg{Msg: "Inc"})
+	thing.Inject(&Msg{Msg: CmdRun})
+	thing.Broadcast(&Msg{Msg: "Update"})
+	thing.bus.receive(newPacket(thing.bus, nil, &Msg{Msg: "Inc"}))
+	thing.recorder.Close()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("Open recording failed: %s", err)
+	}
+	defer f.Close()
+
+	var dirs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Bad record %s: %s", scanner.Text(), err)
+		}
+		dirs = append(dirs, rec.Dir+":"+rec.Src)
+	}
+
+	want := "receive:browser receive:browser receive:SYSTEM " +
+		"broadcast:SYSTEM receive:SYSTEM"
+	if got := strings.Join(dirs, " "); got != want {
+		t.Errorf("Recorded %s, want %s", got, want)
+	}
+
+	// Replay into a fresh Thing, configured to record to the same file
+	k = &keeper{}
+	thing = NewThing(k)
+	thing.Cfg.Id = testId
+	thing.Cfg.RecordFile = file
+
+	f.Seek(0, 0)
+	if err := thing.Replay(f, false); err != nil {
+		t.Fatalf("Replay failed: %s", err)
+	}
+	if k.Count != 3 {
+		t.Errorf("Replayed Count %d, want 3", k.Count)
+	}
+
+	// The replay isn't recorded
+	if thing.recorder != nil {
+		t.Errorf("Replay started recorder")
+	}
+	recording, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Read recording failed: %s", err)
+	}
+	if lines := strings.Count(string(recording), "\n"); lines != 5 {
+		t.Errorf("Recording has %d Records after replay, want 5", lines)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRequestTimeout is returned by Request() if a reply isn't received
+// before the timeout.
+var ErrRequestTimeout = errors.New("Request timed out")
+
+// Request and reply messages are tagged with a request Id so a reply can be
+// matched up with its request.  The Id is the requester's Thing id, a random
+// nonce for the requester's bus, and a count.  Thing and Thing Prime share
+// Thing's id, so the nonce keeps their Ids from colliding.  The tags ride
+// along in the JSON-encoded message:
+//
+//	{"_Req":"thing01-9c41e07a-7","Msg":"_GetState"}
+//	{"_Rsp":"thing01-9c41e07a-7","Msg":"_ReplyState","Temp":72}
+//
+// Messages decoded into Go structs simply ignore the tags.
+const (
+	tagReq = "_Req"
+	tagRsp = "_Rsp"
+)
+
+type msgTags struct {
+	Req string `json:"_Req"`
+	Rsp string `json:"_Rsp"`
+}
+
+// Tag a JSON-encoded message object with key:val
+func tagMsg(msg []byte, key, val string) []byte {
+	i := bytes.IndexByte(msg, '{')
+	if i < 0 {
+		return msg
+	}
+
+	tag := `"` + key + `":"` + val + `"`
+	rest := bytes.TrimSpace(msg[i+1:])
+	if len(rest) > 0 && rest[0] != '}' {
+		tag += ","
+	}
+
+	tagged := make([]byte, 0, len(msg)+len(tag))
+	tagged = append(tagged, msg[:i+1]...)
+	tagged = append(tagged, tag...)
+	tagged = append(tagged, msg[i+1:]...)
+
+	return tagged
+}
+
+// Replied checks if Packet is a reply to an outstanding request, and if so,
+// hands the Packet to the requester.  If the Packet is itself a request, the
+// request Id is saved in the Packet so the reply can be tagged.
+func (b *bus) replied(p *Packet) bool {
+	var tags msgTags
+
+	if !bytes.Contains(p.msg, []byte(`"_R`)) {
+		return false
+	}
+
+	p.Unmarshal(&tags)
+
+	if tags.Req != "" {
+		p.reqId = tags.Req
+	}
+
+	if tags.Rsp == "" {
+		return false
+	}
+
+	b.reqLock.Lock()
+	reply, ok := b.requests[tags.Rsp]
+	if ok {
+		delete(b.requests, tags.Rsp)
+	}
+	b.reqLock.Unlock()
+
+	if !ok {
+		// Requester is gone (timed out?); let the subscribers
+		// have it
+		return false
+	}
+
+	b.thing.log.printf("Received reply [%s]: %.80s", p.Src(), p.String())
+	reply <- p
+
+	return true
+}
+
+// Tag reply with the request Id.  Only the first reply to a request is
+// tagged.
+func (b *bus) tagReply(p *Packet) {
+	if p.reqId != "" {
+		p.msg = tagMsg(p.msg, tagRsp, p.reqId)
+		p.reqId = ""
+	}
+}
+
+// Random nonce for a bus's request Ids
+func newRequestNonce() string {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return fmt.Sprintf("%x", buf)
+}
+
+func (b *bus) newRequestId() string {
+	n := atomic.AddUint64(&b.reqNext, 1)
+	return b.thing.id + "-" + b.reqNonce + "-" + strconv.FormatUint(n, 10)
+}
+
+// Send request to socket and wait for reply
+func (b *bus) request(p *Packet, sock socketer, timeout time.Duration) (*Packet, error) {
+	id := b.newRequestId()
+	reply := make(chan *Packet, 1)
+
+	b.reqLock.Lock()
+	b.requests[id] = reply
+	b.reqLock.Unlock()
+
+	cancel := func() {
+		b.reqLock.Lock()
+		delete(b.requests, id)
+		b.reqLock.Unlock()
+	}
+
+	req := &Packet{bus: b, src: p.src, msg: tagMsg(p.msg, tagReq, id)}
+
+	b.thing.log.printf("Request [%s] to [%s]: %.80s", id, sock.Src(),
+		req.String())
+
+	if err := b.sendSock(req, sock); err != nil {
+		cancel()
+		return nil, fmt.Errorf("Request [%s] send failed: %w", id, err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case rsp := <-reply:
+		return rsp, nil
+	case <-timer.C:
+		cancel()
+		return nil, fmt.Errorf("Request [%s] to [%s]: %w", id,
+			sock.Src(), ErrRequestTimeout)
+	}
+}
+
+// Request sends msg to destination dst and waits for the reply.  The reply
+// Packet is returned, or an error if the destination is unknown or no reply
+// was received within timeout.
+//
+// The request is tagged with a request Id and the destination's reply is
+// tagged with the same Id, so the reply is matched up with the request and
+// isn't confused with other messages on the bus.  The reply is returned to
+// the requester and is not passed to Subscribers().  The destination replies
+// to a request the usual way, with p.Reply().  If the destination couldn't
+// process the request, the reply may be a ReplyError message.
+//
+//	func (t *thermo) poll(p *merle.Packet) {
+//		msg := merle.Msg{Msg: merle.GetState}
+//		rsp, err := p.Request(t.Relays.Id, &msg, time.Second)
+//		if err != nil {
+//			return
+//		}
+//		var relays relays.Relays
+//		rsp.Unmarshal(&relays)
+//		...
+//	}
+//
+// Request blocks waiting for the reply, so don't call Request from a
+// subscriber handler processing Packets from the same source the reply will
+// come back on.  Call Request from a separate go func instead.
+func (p *Packet) Request(dst string, msg interface{}, timeout time.Duration) (*Packet, error) {
+	sock := p.bus.lookup(dst)
+	if sock == nil {
+		return nil, fmt.Errorf("Request destination [%s] unknown", dst)
+	}
+	req := newPacket(p.bus, p.src, msg)
+	return p.bus.request(req, sock, timeout)
+}
+
+// Request sends msg to destination dst on Thing's bus and waits for the
+// reply.  See Packet.Request().
+//
+// On Thing Prime, a Request with dst equal to the Thing's Id is sent to the
+// real Thing.
+func (t *Thing) Request(dst string, msg interface{}, timeout time.Duration) (*Packet, error) {
+	var sock socketer
+
+	if t.isPrime && dst == t.id && t.primeSock != nil {
+		sock = t.primeSock
+	} else {
+		sock = t.bus.lookup(dst)
+	}
+
+	if sock == nil {
+		return nil, fmt.Errorf("Request destination [%s] unknown", dst)
+	}
+
+	req := newPacket(t.bus, nil, msg)
+	return t.bus.request(req, sock, timeout)
+}
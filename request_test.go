@@ -0,0 +1,129 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type pong struct {
+}
+
+func (p *pong) ping(pkt *Packet) {
+	msg := Msg{Msg: "Pong"}
+	pkt.Marshal(&msg).Reply()
+}
+
+func (p *pong) Subscribers() Subscribers {
+	return Subscribers{
+		"Ping": p.ping,
+	}
+}
+
+func (p *pong) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+// Wire up mother and child buses like a bridge does
+func wireThings(t *testing.T, mother, child Thinger) (*Thing, *Thing) {
+	return wire(t, NewThing(mother), NewThing(child))
+}
+
+func wire(t *testing.T, m, c *Thing) (*Thing, *Thing) {
+	m.Cfg.Id = "mother"
+	if err := m.build(false); err != nil {
+		t.Fatalf("Build mother failed: %s", err)
+	}
+
+	c.Cfg.Id = "child"
+	if err := c.build(false); err != nil {
+		t.Fatalf("Build child failed: %s", err)
+	}
+
+	c.bridgeSock = newWireSocket("bridge sock", m.bus, nil)
+	c.childSock = newWireSocket("child sock", c.bus, c.bridgeSock)
+	c.bridgeSock.opposite = c.childSock
+
+	m.bus.plugin(c.childSock)
+	c.bus.plugin(c.bridgeSock)
+
+	return m, c
+}
+
+func TestTagMsg(t *testing.T) {
+	tests := []struct{ msg, want string }{
+		{`{"Msg":"Ping"}`, `{"_Req":"x-1","Msg":"Ping"}`},
+		{`{}`, `{"_Req":"x-1"}`},
+		{`{ }`, `{"_Req":"x-1" }`},
+		{`null`, `null`},
+	}
+
+	for _, test := range tests {
+		got := string(tagMsg([]byte(test.msg), tagReq, "x-1"))
+		if got != test.want {
+			t.Errorf("tagMsg(%s) = %s, want %s", test.msg, got, test.want)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	mother, _ := wireThings(t, &sparse{}, &pong{})
+
+	msg := Msg{Msg: "Ping"}
+	rsp, err := mother.Request("child", &msg, time.Second)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+
+	rsp.Unmarshal(&msg)
+	if msg.Msg != "Pong" {
+		t.Errorf("Request got %s, want Pong", msg.Msg)
+	}
+
+	if len(mother.bus.requests) != 0 {
+		t.Errorf("Request left %d outstanding requests",
+			len(mother.bus.requests))
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	mother, _ := wireThings(t, &sparse{}, &sparse{})
+
+	msg := Msg{Msg: "Ping"}
+	_, err := mother.Request("child", &msg, 10*time.Millisecond)
+	if !errors.Is(err, ErrRequestTimeout) {
+		t.Errorf("Request should have timed out, got: %v", err)
+	}
+
+	_, err = mother.Request("nobody", &msg, 10*time.Millisecond)
+	if err == nil {
+		t.Errorf("Request to unknown destination should have failed")
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	// Thing and Thing Prime run with the same id, on different buses
+	thing := NewThing(&pong{})
+	thing.id = "thing01"
+	a := newBus(thing, 1, Subscribers{})
+	b := newBus(thing, 1, Subscribers{})
+
+	idA, idB := a.newRequestId(), b.newRequestId()
+	if idA == idB {
+		t.Errorf("Request Ids collide: %s", idA)
+	}
+	if !strings.HasPrefix(idA, "thing01-") {
+		t.Errorf("Request Id %s isn't Thing's", idA)
+	}
+	if next := a.newRequestId(); next == idA {
+		t.Errorf("Request Id %s repeated", next)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+// Keep Packet as the last value for its message type.  Call with retainLock
+// held.  The bus shares p with every socket the retained messages are
+// replayed to, so p must not be changed once retained.
+func (b *bus) retain(p *Packet) {
+	var msg Msg
+
+	p.Unmarshal(&msg)
+	if msg.Msg == "" {
+		return
+	}
+
+	if _, ok := b.retained[msg.Msg]; !ok {
+		b.retainKeys = append(b.retainKeys, msg.Msg)
+	}
+	b.retained[msg.Msg] = p
+}
+
+// Hold a broadcast for sockets still being caught up on the retained
+// messages; the socket gets the broadcast once caught up (see
+// enableBroadcast).  Returns the sockets to send the broadcast to now.  Call
+// with retainLock held.  Like a retained Packet, p must not be changed once
+// held.
+func (b *bus) holdBroadcast(p *Packet, socks []bcastSock) []bcastSock {
+	if len(b.replaying) == 0 {
+		return socks
+	}
+
+	now := socks[:0]
+	for _, s := range socks {
+		if held, ok := b.replaying[s.sock]; ok {
+			b.replaying[s.sock] = append(held, p)
+			continue
+		}
+		now = append(now, s)
+	}
+
+	return now
+}
+
+// Enable socket for broadcasts.  If the socket wasn't already enabled,
+// replay the retained messages to the socket, so it's caught up.
+//
+// Broadcasts to the socket while the replay is in flight are held and sent
+// after the replay, in order, so the socket always ends up with the latest
+// value of each retained message.
+func (b *bus) enableBroadcast(sock socketer) {
+	// Only sockets plugged into the bus get broadcasts.  System sockets,
+	// like the state store's, aren't plugged in, so there's nothing to
+	// enable or replay.
+	if !b.plugged(sock) {
+		return
+	}
+
+	b.retainLock.Lock()
+
+	flags := sock.Flags()
+	if flags&sock_flag_bcast != 0 {
+		b.retainLock.Unlock()
+		return
+	}
+	sock.SetFlags(flags | sock_flag_bcast)
+
+	if len(b.retainKeys) == 0 {
+		b.retainLock.Unlock()
+		return
+	}
+
+	replay := make([]*Packet, 0, len(b.retainKeys))
+	for _, key := range b.retainKeys {
+		replay = append(replay, b.retained[key])
+	}
+	if b.replaying == nil {
+		b.replaying = make(map[socketer][]*Packet)
+	}
+	b.replaying[sock] = nil
+
+	b.retainLock.Unlock()
+
+	b.thing.log.printf("Replaying %d retained messages to %s",
+		len(replay), sock.Name())
+
+	q := b.sockQueue(sock)
+	for {
+		for _, p := range replay {
+			b.sockSend(sock, q, p)
+		}
+
+		// Send any broadcasts held during the replay, until none are
+		// left
+		b.retainLock.Lock()
+		replay = b.replaying[sock]
+		if len(replay) == 0 {
+			delete(b.replaying, sock)
+			b.retainLock.Unlock()
+			return
+		}
+		b.replaying[sock] = nil
+		b.retainLock.Unlock()
+	}
+}
@@ -22,3 +22,38 @@ type socketer interface {
 	SetFlags(uint32)
 	Src() string
 }
+
+// sysSocket is the source socket for Packets originating from the system,
+// rather than from a socket plugged into the bus.  sysSocket isn't plugged
+// into the bus.  Replies sent to a sysSocket are (silently) dropped.
+type sysSocket struct {
+	name  string
+	flags uint32
+}
+
+func newSysSocket(name string) *sysSocket {
+	return &sysSocket{name: name}
+}
+
+func (s *sysSocket) Send(p *Packet) error {
+	return nil
+}
+
+func (s *sysSocket) Close() {
+}
+
+func (s *sysSocket) Name() string {
+	return s.name
+}
+
+func (s *sysSocket) Flags() uint32 {
+	return s.flags
+}
+
+func (s *sysSocket) SetFlags(flags uint32) {
+	s.flags = flags
+}
+
+func (s *sysSocket) Src() string {
+	return s.name
+}
@@ -0,0 +1,106 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"reflect"
+	"sync"
+)
+
+// State is embedded in a Thinger to handle GetState and ReplyState for the
+// Thinger.  The Thinger's exported fields are its state:
+//
+//	type relays struct {
+//		merle.State
+//		States [4]bool
+//	}
+//
+//	func (r *relays) Subscribers() merle.Subscribers {
+//		return merle.Subscribers{
+//			"Click": merle.Handle(r.click),
+//		}
+//	}
+//
+// When Thing is built, handlers for GetState and ReplyState are added to the
+// Thinger's Subscribers(), unless the Thinger already subscribes to them.
+// On GetState, the Thinger is locked, marshaled as a ReplyState message, and
+// sent in reply.  On ReplyState, the Thinger is locked and the message is
+// unmarshaled into the Thinger.  So Thing Prime's copy of the Thinger stays
+// in sync with Thing with no further code.
+//
+// State embeds a sync.Mutex; use the Thinger's Lock() and Unlock() to guard
+// the state in the Thinger's own handlers.  State supplies the Msg field, if
+// the Thinger doesn't have its own.
+type State struct {
+	sync.Mutex
+	Msg     string
+	thinger interface{}
+}
+
+// stater is a Thinger embedding State
+type stater interface {
+	stateSubscribers(thinger interface{}, subs Subscribers) Subscribers
+}
+
+func (s *State) stateSubscribers(thinger interface{},
+	subs Subscribers) Subscribers {
+
+	s.thinger = thinger
+
+	merged := make(Subscribers, len(subs)+2)
+	for msg, f := range subs {
+		merged[msg] = f
+	}
+	if _, ok := merged[GetState]; !ok {
+		merged[GetState] = s.getState
+	}
+	if _, ok := merged[ReplyState]; !ok {
+		merged[ReplyState] = s.saveState
+	}
+
+	return merged
+}
+
+func (s *State) getState(p *Packet) {
+	s.Lock()
+	setMsg(s.thinger, ReplyState)
+	p.Marshal(s.thinger)
+	s.Unlock()
+	p.Reply()
+}
+
+func (s *State) saveState(p *Packet) {
+	s.Lock()
+	p.Unmarshal(s.thinger)
+	s.Unlock()
+}
+
+// Add State's handlers to the Thinger's Subscribers(), if the Thinger embeds
+// State
+func (t *Thing) stateSubscribers(subs Subscribers) Subscribers {
+	if s, ok := t.thinger.(stater); ok {
+		return s.stateSubscribers(t.thinger, subs)
+	}
+	return subs
+}
+
+// Set the string field Msg in struct (or pointer to struct) v, if v has one
+func setMsg(v interface{}, msg string) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return
+	}
+
+	field := rv.FieldByName("Msg")
+	if field.IsValid() && field.Kind() == reflect.String && field.CanSet() {
+		field.SetString(msg)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"testing"
+)
+
+type stateful struct {
+	State
+	Temp int
+	Ids  []string
+}
+
+func (s *stateful) Subscribers() Subscribers {
+	return Subscribers{}
+}
+
+func (s *stateful) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+// ownMsg has its own Msg field, shadowing State's
+type ownMsg struct {
+	State
+	Msg  string
+	Temp int
+}
+
+func (o *ownMsg) Subscribers() Subscribers {
+	return Subscribers{}
+}
+
+func (o *ownMsg) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+func stateThing(t *testing.T, thinger Thinger) (*Thing, *catcher) {
+	thing := NewThing(thinger)
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+	return thing, &catcher{sysSocket: sysSocket{name: "catcher"},
+		pkts: make(chan string, 10)}
+}
+
+func TestState(t *testing.T) {
+	s := &stateful{Temp: 70, Ids: []string{"a"}}
+	thing, c := stateThing(t, s)
+
+	thing.bus.receive(newPacket(thing.bus, c, &Msg{Msg: GetState}))
+	want := `{"Msg":"_ReplyState","Temp":70,"Ids":["a"]}`
+	if got := c.caught(); len(got) != 1 || got[0] != want {
+		t.Errorf("GetState replied %v, want %s", got, want)
+	}
+
+	thing.bus.receive(newPacket(thing.bus, c,
+		&stateful{State: State{Msg: ReplyState}, Temp: 75}))
+	if s.Temp != 75 || s.Ids != nil {
+		t.Errorf("ReplyState saved %+v, want Temp 75, no Ids", s)
+	}
+
+	o := &ownMsg{Temp: 60}
+	thing, c = stateThing(t, o)
+
+	thing.bus.receive(newPacket(thing.bus, c, &Msg{Msg: GetState}))
+	want = `{"Msg":"_ReplyState","Temp":60}`
+	if got := c.caught(); len(got) != 1 || got[0] != want {
+		t.Errorf("GetState replied %v, want %s", got, want)
+	}
+}
+
+// overrider has its own GetState handler
+type overrider struct {
+	stateful
+}
+
+func (o *overrider) getState(p *Packet) {
+	p.Marshal(&Msg{Msg: ReplyState}).Reply()
+}
+
+func (o *overrider) Subscribers() Subscribers {
+	return Subscribers{GetState: o.getState}
+}
+
+func TestStateOverride(t *testing.T) {
+	o := &overrider{stateful{Temp: 70}}
+	thing, c := stateThing(t, o)
+
+	thing.bus.receive(newPacket(thing.bus, c, &Msg{Msg: GetState}))
+	want := `{"Msg":"_ReplyState"}`
+	if got := c.caught(); len(got) != 1 || got[0] != want {
+		t.Errorf("GetState replied %v, want %s", got, want)
+	}
+
+	// ReplyState still handled by State
+	thing.bus.receive(newPacket(thing.bus, c,
+		&Msg{Msg: ReplyState}))
+	if o.Temp != 70 {
+		t.Errorf("ReplyState changed Temp to %d", o.Temp)
+	}
+	thing.bus.receive(newPacket(thing.bus, c,
+		&stateful{State: State{Msg: ReplyState}, Temp: 80}))
+	if o.Temp != 80 {
+		t.Errorf("ReplyState saved Temp %d, want 80", o.Temp)
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CmdInit message, if Thing has a saved state.  See ThingConfig.StateDir.
+type MsgInit struct {
+	Msg string
+	// Thing's saved state, as it was in Thing's last ReplyState, minus
+	// the Msg member
+	State json.RawMessage
+}
+
+// RestoreState decodes Thing's saved state, handed to the CmdInit handler,
+// into v.  RestoreState returns false if there is no saved state, in which
+// case v is untouched.  See ThingConfig.StateDir.
+//
+//	func (t *thing) init(p *merle.Packet) {
+//		if !p.RestoreState(t) {
+//			t.SetPoint = 70 // first run; use defaults
+//		}
+//	}
+func (p *Packet) RestoreState(v interface{}) bool {
+	var msg MsgInit
+
+	if err := p.Unmarshal(&msg); err != nil || msg.Msg != CmdInit ||
+		len(msg.State) == 0 {
+		return false
+	}
+
+	return json.Unmarshal(msg.State, v) == nil
+}
+
+// How often a changed state is saved
+const storeInterval = time.Second
+
+// A stateStore saves Thing's state to a file, so the state survives a
+// restart.  The state is saved as JSON in <dir>/<id>.json (or
+// <dir>/<model>.prime.json, for Thing Prime's copy of the state; Prime
+// doesn't know Thing's id until Thing attaches, so the file is named by
+// Thing's model, which Prime knows from the start).
+//
+// On Thing, the store watches the bus for messages which may change Thing's
+// state: any non-system message received or broadcast.  The changed state
+// is fetched from Thing with GetState and saved, at most once every
+// storeInterval, and once more when Thing stops.
+//
+// On Thing Prime, the store saves Prime's last known copy of Thing's state,
+// kept up to date by ReplyState and StatePatch messages from Thing.
+type stateStore struct {
+	thing *Thing
+	dir   string
+	sync.Mutex
+	dirty    bool
+	snapshot []byte // Prime's pending copy of state
+	saved    []byte // last saved state
+	done     chan bool
+	stopOnce sync.Once
+	stopped  chan bool
+}
+
+func newStateStore(t *Thing, dir string) *stateStore {
+	if dir == "" {
+		return nil
+	}
+
+	s := &stateStore{
+		thing: t,
+		dir:   dir,
+		done:  make(chan bool),
+	}
+
+	if !t.isPrime {
+		// Watch Thing's bus for state changes
+		t.bus.use(s)
+	}
+
+	return s
+}
+
+func (s *stateStore) path() string {
+	name := s.thing.id
+	if s.thing.isPrime {
+		name = s.thing.Cfg.Model + ".prime"
+	}
+	return filepath.Join(s.dir, name+".json")
+}
+
+// Load saved state, or nil if there is none
+func (s *stateStore) load() []byte {
+	state, err := os.ReadFile(s.path())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.thing.log.printf("Reading saved state failed: %s", err)
+		}
+		return nil
+	}
+	s.saved = state
+	return state
+}
+
+// Save state, if changed since last save.  The file is replaced atomically,
+// so a crash mid-save doesn't lose the previous state.
+func (s *stateStore) save(state []byte) {
+	if state == nil || bytes.Equal(state, s.saved) {
+		return
+	}
+
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		s.thing.log.printf("Saving state failed: %s", err)
+		return
+	}
+
+	path := s.path()
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, state, 0600); err != nil {
+		s.thing.log.printf("Saving state failed: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		s.thing.log.printf("Saving state failed: %s", err)
+		return
+	}
+
+	s.saved = state
+}
+
+// Strip the top-level Msg member from a ReplyState, leaving just the state
+func stripState(msg []byte) []byte {
+	var state map[string]json.RawMessage
+
+	if err := json.Unmarshal(msg, &state); err != nil {
+		return nil
+	}
+	for key := range state {
+		if key == "Msg" || strings.HasPrefix(key, "_") {
+			delete(state, key)
+		}
+	}
+
+	stripped, _ := json.Marshal(state)
+	return stripped
+}
+
+// A stateSocket is the source of the GetState the store sends to Thing, and
+// catches Thing's ReplyState
+type stateSocket struct {
+	sysSocket
+	reply chan []byte
+}
+
+func (s *stateSocket) Send(p *Packet) error {
+	select {
+	case s.reply <- p.msg:
+	default:
+	}
+	return nil
+}
+
+// Fetch Thing's current state with a GetState
+func (s *stateStore) getState() []byte {
+	sock := &stateSocket{
+		sysSocket: sysSocket{name: "STORE"},
+		reply:     make(chan []byte, 1),
+	}
+
+	msg := Msg{Msg: GetState}
+	s.thing.bus.receive(newPacket(s.thing.bus, sock, &msg))
+
+	select {
+	case reply := <-sock.reply:
+		return stripState(reply)
+	case <-time.After(storeInterval):
+		s.thing.log.println("Saving state failed: no ReplyState")
+		return nil
+	}
+}
+
+func (s *stateStore) flush() {
+	s.Lock()
+	dirty, snapshot := s.dirty, s.snapshot
+	s.dirty = false
+	s.Unlock()
+
+	if !dirty {
+		return
+	}
+
+	if s.thing.isPrime {
+		s.save(snapshot)
+	} else {
+		s.save(s.getState())
+	}
+}
+
+// Mark state changed
+func (s *stateStore) touch() {
+	s.Lock()
+	s.dirty = true
+	s.Unlock()
+}
+
+// Intercept marks the state changed on any non-system message received or
+// broadcast on Thing's bus
+func (s *stateStore) Intercept(p *Packet, dir Direction, next func(*Packet)) {
+	next(p)
+
+	if dir != DirReceive && dir != DirBroadcast {
+		return
+	}
+
+	var msg Msg
+	p.Unmarshal(&msg)
+	if !strings.HasPrefix(msg.Msg, "_") || msg.Msg == StatePatch {
+		s.touch()
+	}
+}
+
+// Update Prime's copy of Thing's state
+func (s *stateStore) primeState(msg []byte) {
+	if s == nil {
+		return
+	}
+	state := stripState(msg)
+	s.Lock()
+	s.snapshot = state
+	s.dirty = true
+	s.Unlock()
+}
+
+// CmdInit Packet, with saved state if any
+func (t *Thing) initPacket() *Packet {
+	if t.store != nil {
+		if state := t.store.load(); state != nil {
+			t.log.printf("Restoring saved state from %s",
+				t.store.path())
+			msg := MsgInit{Msg: CmdInit, State: state}
+			return newPacket(t.bus, nil, &msg)
+		}
+	}
+	msg := Msg{Msg: CmdInit}
+	return newPacket(t.bus, nil, &msg)
+}
+
+// Hand Thing Prime's saved copy of Thing's state to Subscribers() as a
+// ReplyState, so Prime has Thing's last known state before Thing connects
+func (t *Thing) primeRestore() {
+	if t.store == nil {
+		return
+	}
+
+	state := t.store.load()
+	if state == nil {
+		return
+	}
+
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(state, &msg); err != nil {
+		t.log.printf("Restoring saved state failed: %s", err)
+		return
+	}
+	msg["Msg"], _ = json.Marshal(ReplyState)
+
+	t.log.printf("Restoring saved state from %s", t.store.path())
+	t.bus.receive(t.NewPacket(msg))
+}
+
+// Start saving changed state
+func (s *stateStore) start() {
+	if s == nil {
+		return
+	}
+
+	s.stopped = make(chan bool)
+
+	go func() {
+		defer close(s.stopped)
+
+		ticker := time.NewTicker(storeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.done:
+				s.flush()
+				return
+			case <-ticker.C:
+				s.flush()
+			}
+		}
+	}()
+}
+
+// Stop saving state, saving any last change
+func (s *stateStore) stop() {
+	if s == nil {
+		return
+	}
+	s.stopOnce.Do(func() {
+		close(s.done)
+		if s.stopped != nil {
+			<-s.stopped
+		}
+	})
+}
@@ -0,0 +1,153 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type keeper struct {
+	sync.Mutex
+	Msg      string
+	Count    int
+	restored bool
+}
+
+func (k *keeper) init(p *Packet) {
+	k.restored = p.RestoreState(k)
+}
+
+func (k *keeper) inc(p *Packet) {
+	k.Lock()
+	k.Count++
+	k.Unlock()
+}
+
+func (k *keeper) getState(p *Packet) {
+	k.Lock()
+	k.Msg = ReplyState
+	p.Marshal(k)
+	k.Unlock()
+	p.Reply()
+}
+
+func (k *keeper) saveState(p *Packet) {
+	k.Lock()
+	p.Unmarshal(k)
+	k.Unlock()
+}
+
+func (k *keeper) Subscribers() Subscribers {
+	return Subscribers{
+		CmdInit:    k.init,
+		GetState:   k.getState,
+		ReplyState: k.saveState,
+		"Inc":      k.inc,
+	}
+}
+
+func (k *keeper) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+func newKeeperThing(t *testing.T, dir string, prime bool) (*Thing, *keeper) {
+	k := &keeper{}
+	thing := NewThing(k)
+	thing.Cfg.Id = testId
+	thing.Cfg.IsPrime = prime
+	thing.Cfg.StateDir = dir
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+	return thing, k
+}
+
+func TestStateStore(t *testing.T) {
+	dir := t.TempDir()
+
+	thing, k := newKeeperThing(t, dir, false)
+	thing.bus.receive(thing.initPacket())
+	if k.restored {
+		t.Fatalf("Restored state on first run")
+	}
+
+	thing.store.start()
+	thing.Inject(&Msg{Msg: "Inc"})
+	thing.Inject(&Msg{Msg: "Inc"})
+	thing.store.stop()
+
+	saved, err := os.ReadFile(filepath.Join(dir, testId+".json"))
+	if err != nil {
+		t.Fatalf("Reading saved state failed: %s", err)
+	}
+	if string(saved) != `{"Count":2}` {
+		t.Errorf("Saved state %s, want {\"Count\":2}", saved)
+	}
+
+	// Restart
+	thing, k = newKeeperThing(t, dir, false)
+	thing.bus.receive(thing.initPacket())
+	if !k.restored || k.Count != 2 {
+		t.Errorf("Restored %t, Count %d; want true, 2", k.restored,
+			k.Count)
+	}
+}
+
+func TestStateStorePrime(t *testing.T) {
+	dir := t.TempDir()
+
+	prime, _ := newKeeperThing(t, dir, true)
+	prime.store.start()
+	prime.store.primeState([]byte(`{"Msg":"_ReplyState","Count":5}`))
+	prime.store.stop()
+
+	if _, err := os.Stat(filepath.Join(dir, "Thing.prime.json")); err != nil {
+		t.Fatalf("Prime state not saved: %s", err)
+	}
+
+	// Restart
+	prime, k := newKeeperThing(t, dir, true)
+	prime.primeRestore()
+	if k.Count != 5 {
+		t.Errorf("Prime restored Count %d, want 5", k.Count)
+	}
+}
+
+// Prime usually runs without an Id, learning Thing's Id only when Thing
+// attaches; Prime still restores its saved copy on restart
+func TestStateStorePrimeNoId(t *testing.T) {
+	dir := t.TempDir()
+
+	newPrime := func() (*Thing, *keeper) {
+		k := &keeper{}
+		prime := NewThing(k)
+		prime.Cfg.IsPrime = true
+		prime.Cfg.StateDir = dir
+		if err := prime.build(false); err != nil {
+			t.Fatalf("Build failed: %s", err)
+		}
+		return prime, k
+	}
+
+	prime, _ := newPrime()
+	prime.store.start()
+	// Thing attached, and replied with its state
+	prime.id = testId
+	prime.store.primeState([]byte(`{"Msg":"_ReplyState","Count":5}`))
+	prime.store.stop()
+
+	// Restart
+	prime, k := newPrime()
+	prime.primeRestore()
+	if k.Count != 5 {
+		t.Errorf("Prime restored Count %d, want 5", k.Count)
+	}
+}
@@ -5,7 +5,10 @@
 package merle
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 )
 
@@ -68,6 +71,7 @@ type Thing struct {
 	id          string
 	model       string
 	name        string
+	onlineLock  sync.RWMutex
 	online      bool
 	startupTime time.Time
 	bus         *bus
@@ -77,11 +81,21 @@ type Thing struct {
 	bridge      *bridge
 	isPrime     bool
 	primePort   *port
-	primeSock   *webSocket
+	primeSock   socketer
 	primeId     string
+	// Thing attached on its link; guarded by primePort's lock
+	primeLinked bool
+	portState   []byte
+	store       *stateStore
+	recorder    io.Closer
+	replaying   bool
 	bridgeSock  *wireSocket
 	childSock   *wireSocket
 	log         *logger
+	done        chan bool
+	stopOnce    sync.Once
+	// Closed once CmdStop is delivered
+	stopped chan bool
 }
 
 // NewThing returns a Thing built from a Thinger.
@@ -99,28 +113,48 @@ func NewThing(thinger Thinger) *Thing {
 		Cfg:     defaultCfg,
 		thinger: thinger,
 		assets:  thinger.Assets(),
+		done:    make(chan bool),
+		stopped: make(chan bool),
 	}
 }
 
+func (t *Thing) setOnline(online bool) {
+	t.onlineLock.Lock()
+	t.online = online
+	t.onlineLock.Unlock()
+}
+
+func (t *Thing) isOnline() bool {
+	t.onlineLock.RLock()
+	defer t.onlineLock.RUnlock()
+	return t.online
+}
+
 func (t *Thing) getIdentity(p *Packet) {
 	resp := MsgIdentity{
 		Msg:         ReplyIdentity,
 		Id:          t.id,
 		Model:       t.model,
 		Name:        t.name,
-		Online:      t.online,
+		Online:      t.isOnline(),
 		StartupTime: t.startupTime,
+		Codec:       t.negotiateCodec(p),
 	}
 	p.Marshal(&resp).Reply()
 }
 
-func (t *Thing) run() error {
+// Time CmdRun handler has to return after CmdStop, before Thing is torn down
+const cmdRunWait = 5 * time.Second
 
-	t.online = true
+func (t *Thing) run(ctx context.Context) error {
 
-	// Force receipt of CmdInit msg
-	msg := Msg{Msg: CmdInit}
-	t.bus.receive(newPacket(t.bus, nil, &msg))
+	t.setOnline(true)
+
+	// Force receipt of CmdInit msg, with any saved state
+	t.bus.receive(t.initPacket())
+
+	// Save state changes from here on
+	t.store.start()
 
 	// After CmdInit, It's safe now to handle html and ws requests.
 	// (CmdInit initializes Thing's state, so it's safe to receive
@@ -135,23 +169,71 @@ func (t *Thing) run() error {
 		t.bridge.start()
 	}
 
-	// Force receipt of CmdRun msg
-	msg = Msg{Msg: CmdRun}
-	t.bus.receive(newPacket(t.bus, nil, &msg))
+	// Force receipt of CmdRun msg.  CmdRun runs on its own go func so
+	// we can wait for either CmdRun to exit or for Thing to be stopped.
+	ran := make(chan bool)
+	go func() {
+		msg := Msg{Msg: CmdRun}
+		t.bus.receive(newPacket(t.bus, nil, &msg))
+		close(ran)
+	}()
+
+	var err error
+
+	select {
+	case <-ran:
+		// Thing should wait forever in CmdRun handler, but just
+		// in case CmdRun handler exits, tear stuff down...
+		err = fmt.Errorf("CmdRun didn't run forever")
+	case <-ctx.Done():
+		t.log.println("Stopping; context done")
+	case <-t.done:
+		t.log.println("Stopping")
+	}
+
+	if err == nil {
+		// Force receipt of CmdStop msg, giving Thing a chance to
+		// quiesce device I/O before we tear stuff down
+		msg := Msg{Msg: CmdStop}
+		t.bus.receive(newPacket(t.bus, nil, &msg))
+		close(t.stopped)
+
+		// Give CmdRun handler a chance to return, so it's not still
+		// using the bus when we tear stuff down
+		select {
+		case <-ran:
+		case <-time.After(cmdRunWait):
+			t.log.printf("CmdRun didn't return within %s of CmdStop; "+
+				"tearing down anyway", cmdRunWait)
+		}
+	}
+
+	t.teardown()
+
+	t.setOnline(false)
+
+	return err
+}
+
+func (t *Thing) teardown() {
+	// Save any last state change while Thing's bus is still up
+	t.store.stop()
 
-	// Thing should wait forever in CmdRun handler, but just
-	// in case CmdRun handler exits, tear stuff down...
+	t.tunnel.stop()
 
 	if t.isBridge {
 		t.bridge.stop()
 	}
 
-	t.tunnel.stop()
-
-	t.web.private.stop()
 	t.web.public.stop()
+	t.web.private.stop()
+
+	// Close any sockets still plugged into the bus
+	t.bus.close()
 
-	return fmt.Errorf("CmdRun didn't run forever")
+	if t.recorder != nil {
+		t.recorder.Close()
+	}
 }
 
 func (t *Thing) build(full bool) error {
@@ -180,10 +262,26 @@ func (t *Thing) build(full bool) error {
 	t.startupTime = time.Now()
 	t.isPrime = t.Cfg.IsPrime
 
-	t.bus = newBus(t, t.Cfg.MaxConnections, t.thinger.Subscribers())
+	t.bus = newBus(t, t.Cfg.MaxConnections,
+		t.stateSubscribers(t.thinger.Subscribers()))
 
 	t.bus.subscribe(GetIdentity, t.getIdentity)
 
+	// Recorder goes first, to see everything.  A replay isn't recorded,
+	// lest it's appended to the very recording being replayed.
+	if !t.replaying {
+		if err := t.startRecorder(); err != nil {
+			return err
+		}
+	}
+
+	t.bus.use(t.Cfg.Middleware...)
+	if interceptor, ok := t.thinger.(Interceptor); ok {
+		t.bus.use(interceptor.Middleware()...)
+	}
+
+	t.store = newStateStore(t, t.Cfg.StateDir)
+
 	t.web = newWeb(t, t.Cfg.PortPublic, t.Cfg.PortPublicTLS,
 		t.Cfg.PortPrivate, t.Cfg.User)
 	t.setAssetsDir(t)
@@ -219,6 +317,60 @@ func (t *Thing) build(full bool) error {
 	return nil
 }
 
+// NewPacket returns a new Packet with message msg on Thing's bus.  The
+// Packet's source is "SYSTEM".  Use NewPacket to send messages from outside of
+// subscriber handlers, for example from a go func polling a sensor.  NewPacket
+// returns a fresh Packet on each call, so it's safe to call from any go
+// func:
+//
+//	b.Lock()
+//	b.Msg = "Update"
+//	pkt := thing.NewPacket(b)
+//	b.Unlock()
+//	pkt.Broadcast()
+//
+// Thing must be running.
+func (t *Thing) NewPacket(msg interface{}) *Packet {
+	return t.newPacketFrom(systemSrc, msg)
+}
+
+func (t *Thing) newPacketFrom(src string, msg interface{}) *Packet {
+	return newPacket(t.bus, newSysSocket(src), msg)
+}
+
+// Inject message msg onto Thing's bus, as if msg was received by Thing.  The
+// message is matched against Thing's Subscribers().  The Packet's source is
+// "SYSTEM".  Any reply is dropped.  Thing must be running.
+func (t *Thing) Inject(msg interface{}) {
+	t.InjectFrom(systemSrc, msg)
+}
+
+// InjectFrom is like Inject, but the Packet's source is src.
+func (t *Thing) InjectFrom(src string, msg interface{}) {
+	if t.bus == nil {
+		return
+	}
+	t.bus.receive(t.newPacketFrom(src, msg))
+}
+
+// Broadcast message msg to everyone on Thing's bus.  Thing must be running.
+// Do not hold locks when calling Broadcast().
+func (t *Thing) Broadcast(msg interface{}) {
+	if t.bus == nil {
+		return
+	}
+	t.NewPacket(msg).Broadcast()
+}
+
+// SendTo sends message msg to destination dst on Thing's bus.  Thing must be
+// running.  Do not hold locks when calling SendTo().
+func (t *Thing) SendTo(dst string, msg interface{}) error {
+	if t.bus == nil {
+		return fmt.Errorf("Thing not running")
+	}
+	return t.bus.send(t.NewPacket(msg), dst)
+}
+
 // Run Thing.  An error is returned if Run() fails.  Configure Thing before
 // running.
 //
@@ -229,6 +381,29 @@ func (t *Thing) build(full bool) error {
 //	}
 //
 func (t *Thing) Run() error {
+	return t.RunContext(context.Background())
+}
+
+// RunContext runs Thing until the context is done or until Thing is stopped
+// with Stop().  On stop, Thing receives a CmdStop message and then Thing's
+// tunnel, bridge and web servers are torn down, in that order.  A stopped
+// Thing returns nil.  An error is returned if RunContext() fails.
+//
+//	func main() {
+//		thing := merle.NewThing(&thing{})
+//		ctx, cancel := context.WithCancel(context.Background())
+//		go func() {
+//			sigs := make(chan os.Signal, 1)
+//			signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+//			<-sigs
+//			cancel()
+//		}()
+//		if err := thing.RunContext(ctx); err != nil {
+//			log.Fatalln(err)
+//		}
+//	}
+//
+func (t *Thing) RunContext(ctx context.Context) error {
 	err := t.build(true)
 	if err != nil {
 		return err
@@ -236,8 +411,24 @@ func (t *Thing) Run() error {
 
 	switch {
 	case t.isPrime:
-		return t.primeRun()
+		return t.primeRun(ctx)
 	default:
-		return t.run()
+		return t.run(ctx)
 	}
 }
+
+// Build builds Thing from its Thinger and Cfg, without running Thing: no web
+// servers, tunnel, bridge or Thing Prime port are started, and CmdInit and
+// CmdRun aren't sent.  Use Build to exercise Thing's bus without a network,
+// for example in tests (see package merletest).  Run() builds Thing itself;
+// don't call Build before Run().
+func (t *Thing) Build() error {
+	return t.build(false)
+}
+
+// Stop a running Thing.  Stop() returns immediately; the call to Run() or
+// RunContext() returns once Thing is torn down.  It's safe to call Stop()
+// more than once.
+func (t *Thing) Stop() {
+	t.stopOnce.Do(func() { close(t.done) })
+}
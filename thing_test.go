@@ -8,10 +8,12 @@
 package merle
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -192,3 +194,171 @@ func TestRun(t *testing.T) {
 		t.Errorf("Run should have errored out")
 	}
 }
+
+type stopper struct {
+	stopped chan bool
+}
+
+func (s *stopper) stop(p *Packet) {
+	close(s.stopped)
+}
+
+func (s *stopper) Subscribers() Subscribers {
+	return Subscribers{
+		CmdRun:  RunForever,
+		CmdStop: s.stop,
+	}
+}
+
+func (s *stopper) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+func TestStop(t *testing.T) {
+	thinger := stopper{stopped: make(chan bool)}
+
+	thing := NewThing(&thinger)
+	thing.Cfg.Id = testId
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		thing.Stop()
+	}()
+
+	start := time.Now()
+	err := thing.Run()
+	if err != nil {
+		t.Errorf("Stopped Run should return nil, got: %s", err)
+	}
+
+	// RunForever returns on CmdStop
+	if elapsed := time.Since(start); elapsed >= cmdRunWait {
+		t.Errorf("Run took %s to stop", elapsed)
+	}
+
+	select {
+	case <-thinger.stopped:
+	default:
+		t.Errorf("CmdStop not received")
+	}
+}
+
+// runner's CmdRun handler runs until CmdStop
+type runner struct {
+	stop     chan bool
+	returned chan bool
+}
+
+func (r *runner) run(p *Packet) {
+	<-r.stop
+	// Still using the bus, after CmdStop
+	p.Marshal(&Msg{Msg: "Bye"}).Broadcast()
+	close(r.returned)
+}
+
+func (r *runner) Subscribers() Subscribers {
+	return Subscribers{
+		CmdRun:  r.run,
+		CmdStop: func(p *Packet) { close(r.stop) },
+	}
+}
+
+func (r *runner) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+func TestStopCmdRun(t *testing.T) {
+	thinger := runner{stop: make(chan bool), returned: make(chan bool)}
+
+	thing := NewThing(&thinger)
+	thing.Cfg.Id = testId
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		thing.Stop()
+	}()
+
+	start := time.Now()
+	if err := thing.Run(); err != nil {
+		t.Errorf("Stopped Run should return nil, got: %s", err)
+	}
+
+	// CmdRun handler returned before Thing was torn down...
+	select {
+	case <-thinger.returned:
+	default:
+		t.Errorf("CmdRun handler still running after Run returned")
+	}
+
+	// ...without waiting out cmdRunWait
+	if elapsed := time.Since(start); elapsed >= cmdRunWait {
+		t.Errorf("Run took %s to stop", elapsed)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	thinger := stopper{stopped: make(chan bool)}
+
+	thing := NewThing(&thinger)
+	thing.Cfg.Id = testId
+	thing.Cfg.PortPrivate = 8082
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+
+	err := thing.RunContext(ctx)
+	if err != nil {
+		t.Errorf("Cancelled RunContext should return nil, got: %s", err)
+	}
+
+	select {
+	case <-thinger.stopped:
+	default:
+		t.Errorf("CmdStop not received")
+	}
+}
+
+type counter struct {
+	sync.Mutex
+	srcs []string
+}
+
+func (c *counter) count(p *Packet) {
+	c.Lock()
+	c.srcs = append(c.srcs, p.Src())
+	c.Unlock()
+}
+
+func (c *counter) Subscribers() Subscribers {
+	return Subscribers{
+		"Count": c.count,
+	}
+}
+
+func (c *counter) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+func TestInject(t *testing.T) {
+	var child counter
+
+	mother, thing := wireThings(t, &sparse{}, &child)
+
+	msg := Msg{Msg: "Count"}
+
+	thing.Inject(&msg)
+	thing.InjectFrom("timer", &msg)
+	mother.Broadcast(&msg)
+	if err := mother.SendTo("child", &msg); err != nil {
+		t.Errorf("SendTo failed: %s", err)
+	}
+	if err := mother.SendTo("nobody", &msg); err == nil {
+		t.Errorf("SendTo unknown destination should have failed")
+	}
+
+	want := []string{"SYSTEM", "timer", "mother", "mother"}
+	if strings.Join(child.srcs, ",") != strings.Join(want, ",") {
+		t.Errorf("Got sources %v, want %v", child.srcs, want)
+	}
+}
@@ -8,26 +8,60 @@
 package merle
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"machine"
+	"strconv"
 	"time"
-	"unicode"
 
+	"tinygo.org/x/drivers/net"
 	"tinygo.org/x/drivers/wifinina"
 )
 
+// On TinyGo, there's no SSH tunnel to mother.  Instead, Thing dials mother's
+// private HTTP server on a link.  See link.
 type tunnel struct {
+	thing      *Thing
+	host       string
+	portRemote uint
+	link       *link
 }
 
 func newTunnel(t *Thing, host, user string,
 	portPrivate, portRemote uint) *tunnel {
-	return &tunnel{}
+	return &tunnel{
+		thing:      t,
+		host:       host,
+		portRemote: portRemote,
+	}
+}
+
+func linkDial(addr string) (io.ReadWriteCloser, error) {
+	return net.Dial("tcp", addr)
 }
 
 func (t *tunnel) start() {
+	if t.host == "" {
+		t.thing.log.println("Skipping link to mother; missing host")
+		return
+	}
+
+	if t.portRemote == 0 {
+		t.thing.log.println("Skipping link to mother; missing remote port")
+		return
+	}
+
+	addr := t.host + ":" + strconv.FormatUint(uint64(t.portRemote), 10)
+	t.link = newLink(t.thing, addr, t.thing.Cfg.MotherToken, linkDial)
+
+	go t.link.run()
 }
 
 func (t *tunnel) stop() {
+	if t.link != nil {
+		t.link.stop()
+	}
 }
 
 type port struct {
@@ -49,7 +83,7 @@ func (t *Thing) primeAttach(p *port, msg *MsgIdentity) error {
 	return nil
 }
 
-func (t *Thing) primeRun() error {
+func (t *Thing) primeRun(ctx context.Context) error {
 	return nil
 }
 
@@ -117,6 +151,50 @@ func (w *webPublic) start() {
 func (w *webPublic) stop() {
 }
 
+func (b *bus) replied(p *Packet) bool {
+	return false
+}
+
+func (b *bus) tagReply(p *Packet) {
+}
+
+func newRequestNonce() string {
+	return ""
+}
+
+func preparePacket(p *Packet, sock socketer) {
+}
+
+func (t *Thing) negotiateCodec(p *Packet) string {
+	return ""
+}
+
+type stateStore struct {
+}
+
+func newStateStore(t *Thing, dir string) *stateStore {
+	return nil
+}
+
+func (s *stateStore) start() {
+}
+
+func (s *stateStore) stop() {
+}
+
+func (t *Thing) startRecorder() error {
+	return nil
+}
+
+func (t *Thing) stateSubscribers(subs Subscribers) Subscribers {
+	return subs
+}
+
+func (t *Thing) initPacket() *Packet {
+	msg := Msg{Msg: CmdInit}
+	return newPacket(t.bus, nil, &msg)
+}
+
 type webSocket struct {
 }
 
@@ -126,7 +204,7 @@ type wireSocket struct {
 type logger struct {
 }
 
-func NewLogger(prefix string, enabled bool) *logger {
+func newLogger(prefix string, enabled bool) *logger {
 	return &logger{}
 }
 
@@ -139,37 +217,25 @@ func (l *logger) println(v ...interface{}) {
 func (l *logger) fatalln(v ...interface{}) {
 }
 
-// TODO encoding/json isn't working with tinygo yet, so
-// TODO these stubs for Marshal and Unmarshal need to be
-// TODO open-coded to work on basic Merle message types
-// TODO like CmdInit and CmdRun and whatever else we
-// TODO might run into on a  tinygo deployment.
+// encoding/json isn't available on TinyGo, so messages are encoded and
+// decoded with their MarshalMerle and UnmarshalMerle methods.  See Marshaler
+// and Unmarshaler.
 
 func jsonMarshal(v interface{}) ([]byte, error) {
-	msg := v.(*Msg)
-	return []byte(fmt.Sprintf("{\"Msg\":\"%s\"}", msg.Msg)), nil
+	switch m := v.(type) {
+	case Marshaler:
+		return MarshalMerle(m), nil
+	case []byte:
+		return m, nil
+	}
+	return nil, fmt.Errorf("Message %T doesn't implement MarshalMerle", v)
 }
 
 func jsonUnmarshal(data []byte, v interface{}) error {
-	msg := v.(*Msg)
-	msg.Msg = ""
-	s := 0
-	for _, ch := range string(data) {
-		switch {
-		case ch == ':':
-			s = 1
-		case ch == '"':
-			switch s {
-			case 1:
-				s = 2
-			}
-		case unicode.IsLetter(ch), ch == '_':
-			if s == 2 {
-				msg.Msg += string(ch)
-			}
-		}
+	if u, ok := v.(Unmarshaler); ok {
+		return UnmarshalMerle(data, u)
 	}
-	return nil
+	return fmt.Errorf("Message %T doesn't implement UnmarshalMerle", v)
 }
 
 func jsonPrettyPrint(msg []byte) string {
@@ -8,18 +8,46 @@
 package merle
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"os"
+	osuser "os/user"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
+const (
+	// Wait before the first retry.  The wait doubles with each failed
+	// attempt in a row, up to tunnelBackoffMax.
+	tunnelBackoffMin = time.Second
+	tunnelBackoffMax = 2 * time.Minute
+	// Send an SSH keepalive this often on an up tunnel.  If
+	// tunnelKeepaliveMax keepalives in a row go unanswered, mother is
+	// gone and the tunnel is torn down.
+	tunnelKeepalive    = 15 * time.Second
+	tunnelKeepaliveMax = 3
+	// Longest wait to connect to mother's SSH server
+	tunnelDialWait = 30 * time.Second
+)
+
+// Mother stopped answering keepalives
+var errTunnelDead = errors.New("Tunnel dead; mother not answering keepalives")
+
 // Tunnel (remote SSH port forwarding) to connect a child Thing to it's mother Thing
 type tunnel struct {
 	thing       *Thing
@@ -27,111 +55,403 @@ type tunnel struct {
 	user        string
 	portPrivate uint
 	portRemote  uint
+	portSSH     uint
+	keyFile     string
+	passphrase  func() ([]byte, error)
+	knownHosts  string
+	sshAgent    bool
+	transport   string
+	portWSS     uint
+	token       string
+	rootCAs     string
+	link        *link
+	backoffMin  time.Duration
+	backoffMax  time.Duration
+	keepalive   time.Duration
+	failures    uint
+	sync.Mutex
+	remote *ssh.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 func newTunnel(t *Thing, host, user string,
 	portPrivate, portRemote uint) *tunnel {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &tunnel{
 		thing:       t,
 		host:        host,
 		user:        user,
 		portPrivate: portPrivate,
 		portRemote:  portRemote,
+		portSSH:     t.Cfg.MotherPortSSH,
+		keyFile:     t.Cfg.MotherKeyFile,
+		passphrase:  t.Cfg.MotherKeyPassphrase,
+		knownHosts:  t.Cfg.MotherKnownHosts,
+		sshAgent:    t.Cfg.MotherSSHAgent,
+		transport:   t.Cfg.MotherTransport,
+		portWSS:     t.Cfg.MotherPortWSS,
+		token:       t.Cfg.MotherToken,
+		rootCAs:     t.Cfg.MotherRootCAs,
+		backoffMin:  tunnelBackoffMin,
+		backoffMax:  tunnelBackoffMax,
+		keepalive:   tunnelKeepalive,
+		ctx:         ctx,
+		cancel:      cancel,
 	}
 }
 
-func getRemote(user, server string) (*ssh.Client, error) {
-	hostKeyCallback, err := knownhosts.New("/home/" + user + "/.ssh/known_hosts")
-	if err != nil {
-		return nil, err
+// User's .ssh directory
+func sshDir(user string) string {
+	home := "/home/" + user
+	if u, err := osuser.Lookup(user); err == nil && u.HomeDir != "" {
+		home = u.HomeDir
 	}
+	return filepath.Join(home, ".ssh")
+}
 
-	// TODO: Allow different key name to be passed in thing.Cfg?
-	// TODO: Currently hardcoded to id_ras
+func (t *tunnel) knownHostsFile() string {
+	if t.knownHosts != "" {
+		return t.knownHosts
+	}
+	return filepath.Join(sshDir(t.user), "known_hosts")
+}
 
-	key, err := ioutil.ReadFile("/home/" + user + "/.ssh/id_rsa")
+func (t *tunnel) readKey(file string) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to read private key: %v", err)
 	}
 
 	signer, err := ssh.ParsePrivateKey(key)
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if t.passphrase == nil {
+			return nil, fmt.Errorf("Private key %s is encrypted; "+
+				"missing passphrase", file)
+		}
+		pass, perr := t.passphrase()
+		if perr != nil {
+			return nil, fmt.Errorf("Unable to get private key "+
+				"passphrase: %v", perr)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, pass)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse private key %s: %v",
+			file, err)
+	}
+
+	return signer, nil
+}
+
+// Signers for the private key file.  If no key file was given, the user's
+// default key files are tried.
+func (t *tunnel) keySigners() ([]ssh.Signer, error) {
+	if t.keyFile != "" {
+		signer, err := t.readKey(t.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.Signer{signer}, nil
+	}
+
+	var signers []ssh.Signer
+
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		file := filepath.Join(sshDir(t.user), name)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+		signer, err := t.readKey(file)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+func (t *tunnel) getRemote() (*ssh.Client, error) {
+	hostKeyCallback, err := knownhosts.New(t.knownHostsFile())
+	if err != nil {
+		return nil, err
+	}
+
+	var signers []ssh.Signer
+
+	if t.sshAgent {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, fmt.Errorf("Unable to use ssh-agent: SSH_AUTH_SOCK not set")
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect to ssh-agent: %v", err)
+		}
+		// Agent signs during the handshake, so hang on to conn
+		// until connected
+		defer conn.Close()
+		agentSigners, err := agent.NewClient(conn).Signers()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get ssh-agent keys: %v", err)
+		}
+		signers = append(signers, agentSigners...)
+	}
+
+	keySigners, err := t.keySigners()
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse private key: %v", err)
+		return nil, err
+	}
+	signers = append(signers, keySigners...)
+
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("No SSH keys for user %s", t.user)
 	}
 
 	config := &ssh.ClientConfig{
-		User: user,
+		User: t.user,
+		// One publickey method for all keys; the client won't try a
+		// second publickey method
 		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
+			ssh.PublicKeys(signers...),
 		},
 		HostKeyCallback: hostKeyCallback,
 	}
 
-	client, err := ssh.Dial("tcp", server+":22", config)
+	addr := net.JoinHostPort(t.host, strconv.FormatUint(uint64(t.portSSH), 10))
+
+	dialer := net.Dialer{Timeout: tunnelDialWait}
+	conn, err := dialer.DialContext(t.ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect: %v", err)
+	}
+
+	// Closing conn aborts the SSH handshake, if the tunnel is stopped
+	// or mother doesn't finish the handshake in time
+	handshaking := make(chan bool)
+	go func() {
+		select {
+		case <-handshaking:
+		case <-t.ctx.Done():
+			conn.Close()
+		case <-time.After(tunnelDialWait):
+			conn.Close()
+		}
+	}()
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	close(handshaking)
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("Unable to connect: %v", err)
 	}
 
-	return client, nil
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
-func (t *tunnel) getPort() (string, error) {
+// Mother isn't a bridge or Thing Prime, so has no port for Thing
+var errNotMother = errors.New("Mother has no ports; Thing trying to be its own Mother?")
 
-	// ssh <user>@<host> curl -s localhost:<privatePort>/port/<id>
+// Longest wait for Mother to reply to a port request
+const tunnelPortWait = 10 * time.Second
 
-	privatePort := strconv.FormatUint(uint64(t.portRemote), 10)
-	cmd := "curl -s localhost:" + privatePort + "/port/" + t.thing.id
+// Ask Mother's private HTTP server for Thing's port, over a direct-tcpip
+// channel on remote
+func (t *tunnel) requestPort(remote *ssh.Client) (uint, error) {
+	addr := "localhost:" + strconv.FormatUint(uint64(t.portRemote), 10)
 
-	t.thing.log.printf("Tunnel getting port [ssh %s@%s %s]",
-		t.user, t.host, cmd)
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return remote.Dial(network, addr)
+			},
+		},
+		Timeout: tunnelPortWait,
+	}
+	defer client.CloseIdleConnections()
 
-	remote, err := getRemote(t.user, t.host)
+	req, err := http.NewRequestWithContext(t.ctx, "GET",
+		"http://"+addr+"/port/"+t.thing.id, nil)
 	if err != nil {
-		return "", fmt.Errorf("Tunnel get remote client failed: %v", err)
+		return 0, err
 	}
-	defer remote.Close()
+	req.Header.Set("Accept", "application/json")
 
-	session, err := remote.NewSession()
+	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("Tunnel get remote session failed: %v", err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return 0, errNotMother
+	default:
+		return 0, fmt.Errorf("Port request failed: %s", resp.Status)
 	}
-	defer session.Close()
 
-	out, err := session.CombinedOutput(cmd)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
 	if err != nil {
-		return "", fmt.Errorf("Tunnel get port failed: %s, err %v", out, err)
+		return 0, err
 	}
 
-	port := string(out)
+	// Older Mothers reply with text
+	if resp.Header.Get("Content-Type") != "application/json" {
+		return textPort(string(body))
+	}
 
-	switch port {
-	case "404 page not found\n":
-		return "", fmt.Errorf("Tunnel weirdness; Thing trying to be its own Mother?; trying again")
-	case "no ports available":
-		return "", fmt.Errorf("Tunnel no ports available; trying again")
+	var reply portReply
+	if err := jsonUnmarshal(body, &reply); err != nil {
+		return 0, fmt.Errorf("Port request reply [%s]: %v", body, err)
+	}
+
+	return reply.result()
+}
+
+// Port from an older Mother's text reply to a port request
+func textPort(text string) (uint, error) {
+	switch text {
 	case "port busy":
-		return "", fmt.Errorf("Tunnel port is busy; trying again")
+		return 0, errPortBusy
+	case "no ports available":
+		return 0, errNoPorts
+	}
+	port, err := strconv.ParseUint(text, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Port request reply [%s]: %v", text, err)
+	}
+	return uint(port), nil
+}
+
+func (t *tunnel) getPort() (string, error) {
+
+	t.thing.log.printf("Tunnel getting port [ssh -p %d %s@%s GET localhost:%d/port/%s]",
+		t.portSSH, t.user, t.host, t.portRemote, t.thing.id)
+
+	remote, err := t.getRemote()
+	if err != nil {
+		return "", fmt.Errorf("Tunnel get remote client failed: %v", err)
+	}
+	defer remote.Close()
+
+	port, err := t.requestPort(remote)
+	if err != nil {
+		return "", fmt.Errorf("Tunnel get port failed: %w; trying again", err)
 	}
 
-	return port, nil
+	return strconv.FormatUint(uint64(port), 10), nil
 }
 
-func reverseForward(client net.Conn, remote net.Conn) {
-	done := make(chan bool)
+// A tunnelConn is one connection on the tunnel, from mother's end of the
+// tunnel (client) to Thing's private port (local).  Bytes are counted in each
+// direction.
+type tunnelConn struct {
+	client net.Conn
+	local  net.Conn
+	// Bytes client -> local
+	bytesIn uint64
+	// Bytes local -> client
+	bytesOut uint64
+}
+
+// countWriter counts bytes written into *count
+type countWriter struct {
+	w     io.Writer
+	count *uint64
+}
+
+func (c countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddUint64(c.count, uint64(n))
+	return n, err
+}
+
+func (c *tunnelConn) in() uint64 {
+	return atomic.LoadUint64(&c.bytesIn)
+}
+
+func (c *tunnelConn) out() uint64 {
+	return atomic.LoadUint64(&c.bytesOut)
+}
+
+func (c *tunnelConn) close() {
+	c.client.Close()
+	c.local.Close()
+}
+
+// Copy data both ways until either side closes
+func (c *tunnelConn) proxy() {
+	done := make(chan bool, 2)
 
 	// Start remote -> local data transfer
 	go func() {
-		io.Copy(client, remote)
+		io.Copy(countWriter{c.local, &c.bytesIn}, c.client)
 		done <- true
 	}()
 
 	// Start local -> remote data transfer
 	go func() {
-		io.Copy(remote, client)
+		io.Copy(countWriter{c.client, &c.bytesOut}, c.local)
 		done <- true
 	}()
 
 	<-done
+	// Closing both sides stops the other transfer
+	c.close()
+	<-done
+}
+
+// Send SSH keepalives on remote until done.  If tunnelKeepaliveMax keepalives
+// in a row go unanswered, close remote, tearing down the tunnel, and signal
+// dead.
+func (t *tunnel) keepalives(remote *ssh.Client, done, dead chan bool) {
+	ticker := time.NewTicker(t.keepalive)
+	defer ticker.Stop()
+
+	missed := 0
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			// Mother replies, even if only to say it doesn't know
+			// keepalives
+			_, _, err := remote.SendRequest("keepalive@openssh.com",
+				true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			if err != nil {
+				// Connection is already gone
+				return
+			}
+			missed = 0
+		case <-time.After(t.keepalive):
+			missed++
+			t.thing.log.printf("Tunnel keepalive missed [%d/%d]",
+				missed, tunnelKeepaliveMax)
+			if missed >= tunnelKeepaliveMax {
+				dead <- true
+				remote.Close()
+				return
+			}
+		}
+	}
 }
 
 func (t *tunnel) tunnel(remotePort string) error {
@@ -141,77 +461,203 @@ func (t *tunnel) tunnel(remotePort string) error {
 	//    ssh -NT -R <remotePort>:localhost:<localPort> <user>@<host>
 	//
 
-	t.thing.log.printf("Tunnel creating tunnel [ssh -NT -R %s:localhost:%d %s@%s]",
-		remotePort, t.portPrivate, t.user, t.host)
+	t.thing.log.printf("Tunnel creating tunnel [ssh -p %d -NT -R %s:localhost:%d %s@%s]",
+		t.portSSH, remotePort, t.portPrivate, t.user, t.host)
 
-	remote, err := getRemote(t.user, t.host)
+	remote, err := t.getRemote()
 	if err != nil {
 		return fmt.Errorf("Tunnel get remote client failed: %v", err)
 	}
 	defer remote.Close()
 
+	// Hang onto remote client so stop() can close it out from under us
+	if !t.setRemote(remote) {
+		return fmt.Errorf("Tunnel stopped")
+	}
+	defer t.setRemote(nil)
+
 	// Listen on remote server port
 	listener, err := remote.Listen("tcp", "localhost:"+remotePort)
 	if err != nil {
 		return fmt.Errorf("Unable to listen on remote server: %v", err)
 	}
 
-	// Handle incoming connections on reverse forwarded tunnel
+	port, _ := strconv.ParseUint(remotePort, 10, 16)
+	t.connected(uint(port))
+
+	done := make(chan bool)
+	dead := make(chan bool, 1)
+	defer close(done)
+	go t.keepalives(remote, done, dead)
+
+	err = t.forward(listener)
+
+	select {
+	case <-dead:
+		return errTunnelDead
+	default:
+	}
+
+	return err
+}
+
+// Handle incoming connections on reverse forwarded tunnel.  Each connection
+// is proxied to Thing's private port, concurrently, until the listener
+// closes.
+func (t *tunnel) forward(listener net.Listener) error {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var conns = make(map[*tunnelConn]bool)
+
+	defer func() {
+		// Tunnel is down; take the connections down with it
+		lock.Lock()
+		for c := range conns {
+			c.close()
+		}
+		lock.Unlock()
+		wg.Wait()
+	}()
+
 	address := fmt.Sprintf("localhost:%d", t.portPrivate)
-	local, err := net.Dial("tcp", address)
+
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		local, err := net.Dial("tcp", address)
+		if err != nil {
+			t.thing.log.printf("Tunnel dial into local service error: %v", err)
+			client.Close()
+			continue
+		}
+
+		c := &tunnelConn{client: client, local: local}
+
+		lock.Lock()
+		conns[c] = true
+		lock.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.thing.log.printf("Tunnel connection opened [%s]",
+				client.RemoteAddr())
+			c.proxy()
+			t.thing.log.printf("Tunnel connection closed [%s] in: %d bytes, out: %d bytes",
+				client.RemoteAddr(), c.in(), c.out())
+			lock.Lock()
+			delete(conns, c)
+			lock.Unlock()
+		}()
+	}
+}
+
+// Send an EventTunnel message to Thing's Subscribers() and to everyone on
+// Thing's bus
+func (t *tunnel) event(state string, port uint, backoff time.Duration, err error) {
+	msg := MsgEventTunnel{
+		Msg:      EventTunnel,
+		State:    state,
+		Port:     port,
+		Failures: t.failures,
+		Backoff:  backoff.Seconds(),
+	}
 	if err != nil {
-		return fmt.Errorf("Dial into local service error: %v", err)
+		msg.Error = err.Error()
+	}
+
+	t.thing.bus.receive(t.thing.NewPacket(&msg))
+	t.thing.NewPacket(&msg).Retain().Broadcast()
+}
+
+func (t *tunnel) connected(port uint) {
+	t.thing.log.println("Tunnel connected on port", port)
+	t.failures = 0
+	t.event(TunnelConnected, port, 0, nil)
+}
+
+// Wait before trying again: backoffMin doubled for each failed attempt in a
+// row, capped at backoffMax, with jitter.  The jitter keeps Things started at
+// the same time from trying in lock step, and contending for ports.
+func (t *tunnel) backoff() time.Duration {
+	wait := t.backoffMax
+	if t.failures < 32 {
+		if w := t.backoffMin << t.failures; w > 0 && w < wait {
+			wait = w
+		}
 	}
-	defer local.Close()
 
-	client, err := listener.Accept()
+	// Somewhere between half the wait and the whole wait
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(wait-half)+1))
+}
+
+func (t *tunnel) connect() error {
+	port, err := t.getPort()
 	if err != nil {
 		return err
 	}
-	defer client.Close()
 
-	reverseForward(client, local)
+	t.thing.log.println("Tunnel got port", port)
 
-	return nil
+	return t.tunnel(port)
 }
 
 func (t *tunnel) create() {
-	var err error
-	var port string
+	defer t.wg.Done()
 
 	rand.Seed(time.Now().UnixNano())
 
 	for {
+		t.event(TunnelConnecting, 0, 0, nil)
 
-		port, err = t.getPort()
-		if err != nil {
-			t.thing.log.println(err)
-			goto again
-		}
+		err := t.connect()
 
-		t.thing.log.println("Tunnel got port", port)
+		if t.isStopped() {
+			break
+		}
 
-		err = t.tunnel(port)
 		if err != nil {
 			t.thing.log.println(err)
-			goto again
+			t.failures++
+		} else {
+			t.thing.log.println("Tunnel disconnected")
 		}
 
-		t.thing.log.println("Tunnel disconnected")
+		wait := t.backoff()
+		t.event(TunnelBackoff, 0, wait, err)
+
+		t.thing.log.printf("Tunnel create sleeping for %s", wait)
+		select {
+		case <-t.ctx.Done():
+		case <-time.After(wait):
+		}
 
-	again:
-		// TODO maybe try some exponential back-off aglo ala TCP
+		if t.isStopped() {
+			break
+		}
+	}
 
-		// Sleep for some number of random seconds between 1 and 10
-		// before trying (again).  This will keep us from grinding
-		// the CPU trying to connect all the time, and in the case
-		// of multi clients starting at exactly the same time will
-		// avoid port contention.
+	t.event(TunnelStopped, 0, 0, nil)
+}
 
-		f := rand.Float32() * 10
-		t.thing.log.printf("Tunnel create sleeping for %f seconds", f)
-		time.Sleep(time.Duration(f*1000) * time.Millisecond)
+// setRemote sets the current remote client.  Returns false if the tunnel
+// has been stopped.
+func (t *tunnel) setRemote(remote *ssh.Client) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.ctx.Err() != nil && remote != nil {
+		return false
 	}
+	t.remote = remote
+	return true
+}
+
+func (t *tunnel) isStopped() bool {
+	return t.ctx.Err() != nil
 }
 
 func (t *tunnel) start() {
@@ -220,6 +666,17 @@ func (t *tunnel) start() {
 		return
 	}
 
+	switch t.transport {
+	case "ssh":
+	case "wss":
+		t.startLink()
+		return
+	default:
+		t.thing.log.printf("Skipping tunnel to mother; unknown transport \"%s\"",
+			t.transport)
+		return
+	}
+
 	if t.user == "" {
 		t.thing.log.println("Skipping tunnel to mother; missing user")
 		return
@@ -230,13 +687,100 @@ func (t *tunnel) start() {
 		return
 	}
 
+	if t.portSSH == 0 {
+		t.thing.log.println("Skipping tunnel to mother; missing SSH port")
+		return
+	}
+
 	if t.portPrivate == 0 {
 		t.thing.log.println("Skipping tunnel to mother; missing private port")
 		return
 	}
 
+	t.wg.Add(1)
 	go t.create()
 }
 
+// Stop the tunnel.  Any attempt in progress is cancelled, an up tunnel is torn
+// down, and stop() returns once the tunnel has stopped.  It's safe to call
+// stop() more than once.
 func (t *tunnel) stop() {
+	t.Lock()
+	t.cancel()
+	// Closing the remote client tears down the tunnel
+	if t.remote != nil {
+		t.remote.Close()
+	}
+	t.Unlock()
+
+	if t.link != nil {
+		t.link.stop()
+	}
+
+	t.wg.Wait()
+}
+
+// TLS config to verify mother's HTTPS server
+func (t *tunnel) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: t.host}
+
+	if t.rootCAs != "" {
+		certs, err := ioutil.ReadFile(t.rootCAs)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(certs) {
+			return nil, fmt.Errorf("No certificates in %s", t.rootCAs)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// Link (see link) to mother's public HTTPS server, over TLS
+func (t *tunnel) newLink() (*link, error) {
+	config, err := t.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dial := func(addr string) (io.ReadWriteCloser, error) {
+		dialer := &net.Dialer{Timeout: tunnelDialWait}
+		return tls.DialWithDialer(dialer, "tcp", addr, config)
+	}
+
+	addr := net.JoinHostPort(t.host, strconv.FormatUint(uint64(t.portWSS), 10))
+
+	return newLink(t.thing, addr, t.token, dial), nil
+}
+
+// Dial home to mother over a link, rather than an SSH tunnel
+func (t *tunnel) startLink() {
+	if t.portWSS == 0 {
+		t.thing.log.println("Skipping link to mother; missing WSS port")
+		return
+	}
+
+	if t.token == "" {
+		t.thing.log.println("Skipping link to mother; missing token")
+		return
+	}
+
+	link, err := t.newLink()
+	if err != nil {
+		t.thing.log.println("Skipping link to mother;", err)
+		return
+	}
+
+	t.thing.log.printf("Tunnel linking to mother [wss://%s%s]", link.addr,
+		linkPath)
+
+	t.link = link
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.link.run()
+	}()
 }
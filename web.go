@@ -19,7 +19,9 @@ import (
 	osuser "os/user"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -32,13 +34,19 @@ type web struct {
 	private  *webPrivate
 	templ    *template.Template
 	templErr error
+	upgrader websocket.Upgrader
+	// How often linked Things ping (see link).  The default is
+	// linkKeepalive.
+	linkKeepalive time.Duration
 }
 
 func newWeb(t *Thing, portPublic, portPublicTLS, portPrivate uint,
 	user string) *web {
 	return &web{
-		public:  newWebPublic(t, portPublic, portPublicTLS, user),
-		private: newWebPrivate(t, portPrivate),
+		public:        newWebPublic(t, portPublic, portPublicTLS, user),
+		private:       newWebPrivate(t, portPrivate),
+		upgrader:      websocket.Upgrader{EnableCompression: t.Cfg.WebSocketCompress},
+		linkKeepalive: linkKeepalive,
 	}
 }
 
@@ -50,12 +58,17 @@ func (w *web) handleBridgePortId() {
 	w.private.mux.HandleFunc("/port/{id}", w.private.getBridgePort)
 }
 
+func (w *web) handleBridgeAttach() {
+	w.private.mux.HandleFunc(linkPath, w.private.bridgeAttach)
+}
+
 func (w *web) staticFiles(t *Thing) {
 	fs := http.FileServer(http.Dir(t.assets.AssetsDir))
 	path := "/" + t.id + "/assets/"
 	w.public.mux.PathPrefix(path).Handler(http.StripPrefix(path, fs))
 }
 
+// Upgrader for links (see link).  Links don't compress.
 var upgrader = websocket.Upgrader{}
 
 // Open a WebSocket on Thing
@@ -78,7 +91,7 @@ func (t *Thing) ws(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+	ws, err := t.web.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		t.log.println("Websocket upgrader error:", err)
 		return
@@ -97,7 +110,7 @@ func (t *Thing) ws(w http.ResponseWriter, r *http.Request) {
 		// New pkt for each rcv
 		var pkt = newPacket(t.bus, sock, nil)
 
-		_, pkt.msg, err = ws.ReadMessage()
+		pkt.msg, err = sock.read()
 		if err != nil {
 			t.log.printf("Websocket closed [%s]", name)
 			break
@@ -109,6 +122,7 @@ func (t *Thing) ws(w http.ResponseWriter, r *http.Request) {
 
 	// Unplug the websocket from Thing's bus
 	t.bus.unplug(sock)
+	sock.Close()
 }
 
 func (t *Thing) setAssetsDir(child *Thing) {
@@ -205,10 +219,8 @@ func (t *Thing) state(w http.ResponseWriter, r *http.Request) {
 	}
 
 	msg := Msg{Msg: GetState}
-	p := newPacket(t.bus, nil, &msg)
-	// TODO: this will cause a "Reply aborted; source is missing" message
-	// TODO: because we set src=nil above for the new packet.
-	// TODO: Maybe make a dummy src that will sink the Reply() silently?
+	// The system src sinks the Reply(); we just want the reply msg
+	p := t.NewPacket(&msg)
 	t.bus.receive(p)
 	fmt.Fprintf(w, jsonPrettyPrint(p.msg))
 }
@@ -273,6 +285,41 @@ func (w *webPublic) basicAuth(authUser string, next http.HandlerFunc) http.Handl
 	})
 }
 
+// Token presented on request matches Thing's AttachToken
+func attachAuth(t *Thing, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	tokenHash := sha256.Sum256([]byte(token))
+	expectedTokenHash := sha256.Sum256([]byte(t.Cfg.AttachToken))
+
+	return subtle.ConstantTimeCompare(tokenHash[:],
+		expectedTokenHash[:]) == 1
+}
+
+// Attach a child which dialed in on its link (see link) over TLS, presenting
+// AttachToken
+func (w *webPublic) attach(writer http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		http.Error(writer, "TLS required", http.StatusForbidden)
+		return
+	}
+
+	if !attachAuth(w.thing, r) {
+		w.thing.log.printf("Attach from %s unauthorized", r.RemoteAddr)
+		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case w.thing.isBridge:
+		w.thing.bridge.linkAttach(writer, r)
+	case w.thing.isPrime:
+		w.thing.primeLinkAttach(writer, r)
+	default:
+		http.Error(writer, "Not a bridge or Thing Prime", http.StatusNotFound)
+	}
+}
+
 // The Thing's public HTTP server
 type webPublic struct {
 	thing *Thing
@@ -319,7 +366,11 @@ func newWebPublic(t *Thing, port, portTLS uint, user string) *webPublic {
 func (w *webPublic) newServer() {
 	w.mux = mux.NewRouter()
 
+	if w.thing.Cfg.AttachToken != "" {
+		w.mux.HandleFunc(linkPath, w.attach)
+	}
 	w.mux.HandleFunc("/ws/{id}", w.basicAuth(w.user, w.thing.ws))
+	w.mux.HandleFunc("/merle.js", w.thing.js)
 	w.mux.HandleFunc("/state", w.basicAuth(w.user, w.thing.state))
 	w.mux.HandleFunc("/{id}/state", w.basicAuth(w.user, w.thing.state))
 	w.mux.HandleFunc("/{id}", w.basicAuth(w.user, w.thing.home))
@@ -472,46 +523,238 @@ func (w *webPrivate) stop() {
 	w.Wait()
 }
 
+// Reply to a port request.  Tunnels ask for JSON (see portReply); anyone
+// else gets the port, or the error, as text.
+func replyPort(writer http.ResponseWriter, r *http.Request, port uint, err error) {
+	if r.Header.Get("Accept") == "application/json" {
+		reply := newPortReply(port, err)
+		data, _ := jsonMarshal(&reply)
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(data)
+		return
+	}
+
+	switch err {
+	case nil:
+		fmt.Fprintf(writer, "%d", port)
+	case errNoPorts:
+		fmt.Fprintf(writer, "no ports available")
+	case errPortBusy:
+		fmt.Fprintf(writer, "port busy")
+	default:
+		fmt.Fprintf(writer, "%s", err)
+	}
+}
+
 func (w *webPrivate) getPrimePort(writer http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	fmt.Fprintf(writer, w.thing.getPrimePort(id))
+	port, err := w.thing.getPrimePort(id)
+	replyPort(writer, r, port, err)
 }
 
 func (w *webPrivate) getBridgePort(writer http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	port := w.thing.bridge.ports.getPort(id)
+	port, err := w.thing.bridge.ports.getPort(id)
+	replyPort(writer, r, port, err)
+}
 
-	switch port {
-	case -1:
-		fmt.Fprintf(writer, "no ports available")
-	case -2:
-		fmt.Fprintf(writer, "port busy")
-	default:
-		fmt.Fprintf(writer, "%d", port)
+// Attach a child which dialed in on its link (see link).  The private port is
+// trusted, unless AttachToken is set, in which case the child must present
+// AttachToken here too.
+func (w *webPrivate) bridgeAttach(writer http.ResponseWriter, r *http.Request) {
+	if w.thing.Cfg.AttachToken != "" && !attachAuth(w.thing, r) {
+		w.thing.log.printf("Attach from %s unauthorized", r.RemoteAddr)
+		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
 	}
+
+	w.thing.bridge.linkAttach(writer, r)
 }
 
+const (
+	// Time allowed to write a message to the websocket
+	wsWriteWait = 10 * time.Second
+	// Messages queued for writing before a websocket is considered a
+	// slow consumer and evicted
+	wsSendQueue = 64
+)
+
+// A webSocket is written to only by its own writer go func, so it's safe to
+// Send() on a webSocket from any number of go funcs.  A webSocket whose
+// writes can't keep up is evicted: the websocket is closed, which in turn
+// unplugs it from the bus.
 type webSocket struct {
-	thing *Thing
-	name  string
-	flags uint32
-	conn  *websocket.Conn
+	thing     *Thing
+	name      string
+	flags     uint32
+	conn      *websocket.Conn
+	send      chan wsMsg
+	done      chan bool
+	closeOnce sync.Once
+	// Codec negotiated for the websocket; nil means JSON.  See Codec.
+	codecLock sync.RWMutex
+	codec     Codec
+	codecSend bool
+}
+
+// A message queued for writing to a websocket; either the raw message, or
+// the message prepared once for a broadcast to many websockets
+type wsMsg struct {
+	data   []byte
+	binary bool
+	prep   *websocket.PreparedMessage
+}
+
+// Prepare the Packet message once for sending on many websockets, if sock is a
+// compressing websocket.  A prepared message is compressed once, rather than
+// once per websocket.  Without compression, there's nothing to gain by
+// preparing the message.
+func preparePacket(p *Packet, sock socketer) {
+	if p.prep != nil {
+		return
+	}
+	ws, ok := sock.(*webSocket)
+	if !ok || !ws.thing.Cfg.WebSocketCompress {
+		return
+	}
+	prep, err := websocket.NewPreparedMessage(websocket.TextMessage, p.msg)
+	if err != nil {
+		return
+	}
+	p.prep = prep
 }
 
 func newWebSocket(thing *Thing, name string, conn *websocket.Conn) *webSocket {
-	return &webSocket{thing: thing, name: name, conn: conn}
+	ws := &webSocket{
+		thing: thing,
+		name:  name,
+		conn:  conn,
+		send:  make(chan wsMsg, wsSendQueue),
+		done:  make(chan bool),
+	}
+	go ws.writer()
+	return ws
+}
+
+func (ws *webSocket) writer() {
+	for {
+		select {
+		case <-ws.done:
+			return
+		case msg := <-ws.send:
+			var err error
+			ws.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if msg.prep != nil {
+				err = ws.conn.WritePreparedMessage(msg.prep)
+			} else if msg.binary {
+				err = ws.conn.WriteMessage(websocket.BinaryMessage,
+					msg.data)
+			} else {
+				err = ws.conn.WriteMessage(websocket.TextMessage,
+					msg.data)
+			}
+			if err != nil {
+				ws.thing.log.printf("Websocket write error [%s]: %s",
+					ws.name, err)
+				ws.Close()
+				return
+			}
+		}
+	}
 }
 
 func (ws *webSocket) Send(p *Packet) error {
-	return ws.conn.WriteMessage(websocket.TextMessage, p.msg)
+	select {
+	case <-ws.done:
+		return fmt.Errorf("Websocket [%s] closed", ws.name)
+	default:
+	}
+
+	msg := wsMsg{data: p.msg}
+
+	if codec := ws.sendCodec(); codec != nil {
+		data, err := encodeMsg(codec, p.msg)
+		if err != nil {
+			return fmt.Errorf("Websocket [%s] %s encode failed: %w",
+				ws.name, codec.Name(), err)
+		}
+		msg = wsMsg{data: data, binary: true}
+	} else if prep, ok := p.prep.(*websocket.PreparedMessage); ok {
+		msg.prep = prep
+	}
+
+	select {
+	case ws.send <- msg:
+		return nil
+	default:
+		ws.thing.log.printf("Websocket slow consumer; evicting [%s]",
+			ws.name)
+		ws.Close()
+		return fmt.Errorf("Websocket [%s] evicted", ws.name)
+	}
+}
+
+// Read the next message from the websocket.  Binary messages are decoded
+// from the negotiated codec to JSON.  Messages which can't be decoded are
+// skipped.
+func (ws *webSocket) read() ([]byte, error) {
+	for {
+		mt, data, err := ws.conn.ReadMessage()
+		if err != nil || mt != websocket.BinaryMessage {
+			return data, err
+		}
+
+		ws.codecLock.Lock()
+		codec := ws.codec
+		if codec != nil {
+			// Other end is using the codec, so we can too
+			ws.codecSend = true
+		}
+		ws.codecLock.Unlock()
+
+		if codec == nil {
+			ws.thing.log.printf("Websocket [%s] binary message "+
+				"without codec; skipping", ws.name)
+			continue
+		}
+
+		msg, err := decodeMsg(codec, data)
+		if err != nil {
+			ws.thing.log.printf("Websocket [%s] %s decode failed; "+
+				"skipping: %s", ws.name, codec.Name(), err)
+			continue
+		}
+
+		return msg, nil
+	}
+}
+
+func (ws *webSocket) setCodec(c Codec, send bool) {
+	ws.codecLock.Lock()
+	defer ws.codecLock.Unlock()
+	ws.codec = c
+	ws.codecSend = send
+}
+
+// Codec to encode sent messages, or nil for JSON
+func (ws *webSocket) sendCodec() Codec {
+	ws.codecLock.RLock()
+	defer ws.codecLock.RUnlock()
+	if !ws.codecSend {
+		return nil
+	}
+	return ws.codec
 }
 
 func (ws *webSocket) Close() {
-	ws.conn.Close()
+	ws.closeOnce.Do(func() {
+		close(ws.done)
+		ws.conn.Close()
+	})
 }
 
 func (ws *webSocket) Name() string {
@@ -0,0 +1,317 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !tinygo
+// +build !tinygo
+
+package merle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type empty struct {
+}
+
+func (e *empty) Subscribers() Subscribers {
+	return Subscribers{
+		GetState: ReplyStateEmpty,
+	}
+}
+
+func (e *empty) Assets() *ThingAssets {
+	return &ThingAssets{}
+}
+
+// Serve Thing's websocket on a test server and dial it
+func dialThing(t *testing.T, thing *Thing) (*websocket.Conn, func()) {
+	server := httptest.NewServer(http.HandlerFunc(thing.ws))
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		server.Close()
+		t.Fatalf("Dial %s failed: %s", url, err)
+	}
+
+	return conn, func() {
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestWebSocketConcurrentBroadcast(t *testing.T) {
+	thing := NewThing(&empty{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+
+	conn, done := dialThing(t, thing)
+	defer done()
+
+	// Enable socket for broadcasts
+	conn.WriteJSON(&Msg{Msg: GetState})
+	var msg Msg
+	conn.ReadJSON(&msg)
+	if msg.Msg != ReplyState {
+		t.Fatalf("Got %s, want %s", msg.Msg, ReplyState)
+	}
+
+	const senders = 4
+	const msgs = 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < msgs; j++ {
+				thing.Broadcast(&Msg{Msg: "Update"})
+			}
+		}()
+	}
+	wg.Wait()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < senders*msgs; i++ {
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Read %d failed: %s", i, err)
+		}
+		if msg.Msg != "Update" {
+			t.Fatalf("Got %s, want Update", msg.Msg)
+		}
+	}
+}
+
+// Retained broadcasts are replayed to websockets joining while the broadcasts
+// are prepared (compressed) for the websockets already joined.  Run with
+// -race.
+func TestWebSocketRetainCompressed(t *testing.T) {
+	const joiners = 10
+
+	thing := NewThing(&empty{})
+	thing.Cfg.Id = testId
+	thing.Cfg.LoggingEnabled = false
+	thing.Cfg.WebSocketCompress = true
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+
+	var wg, joined sync.WaitGroup
+
+	// Join a websocket, enabling it for broadcasts, and drain it
+	join := func() {
+		conn, done := dialThing(t, thing)
+		conn.WriteJSON(&Msg{Msg: GetState})
+		wg.Add(1)
+		joined.Add(1)
+		go func() {
+			var once sync.Once
+			defer wg.Done()
+			defer done()
+			defer once.Do(joined.Done)
+			var msg Msg
+			for msg.Msg != "Last" {
+				msg = Msg{}
+				if err := conn.ReadJSON(&msg); err != nil {
+					t.Errorf("Read failed: %s", err)
+					return
+				}
+				if msg.Msg == ReplyState {
+					once.Do(joined.Done)
+				}
+			}
+		}()
+	}
+
+	join()
+
+	// Broadcast until everyone has joined
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			thing.NewPacket(&msgAlarm{Msg: "Alarm", Level: i}).
+				Retain().Broadcast()
+			// Not so fast the websockets are evicted
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	for i := 0; i < joiners; i++ {
+		join()
+	}
+
+	joined.Wait()
+	close(stop)
+	<-stopped
+
+	thing.NewPacket(&Msg{Msg: "Last"}).Retain().Broadcast()
+	wg.Wait()
+}
+
+func TestWebSocketEviction(t *testing.T) {
+	thing := NewThing(&empty{})
+	thing.Cfg.Id = testId
+	if err := thing.build(false); err != nil {
+		t.Fatalf("Build failed: %s", err)
+	}
+
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, _ := thing.web.upgrader.Upgrade(w, r, nil)
+			conns <- conn
+		}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial %s failed: %s", url, err)
+	}
+	defer client.Close()
+
+	// A webSocket without a writer go func never drains its send queue,
+	// like a consumer that can't keep up
+	ws := &webSocket{
+		thing: thing,
+		name:  "slow",
+		conn:  <-conns,
+		send:  make(chan wsMsg, 1),
+		done:  make(chan bool),
+	}
+
+	p := newPacket(thing.bus, nil, &Msg{Msg: "Update"})
+
+	if err := ws.Send(p); err != nil {
+		t.Errorf("First send failed: %s", err)
+	}
+	if err := ws.Send(p); err == nil {
+		t.Errorf("Send to slow consumer should have evicted")
+	}
+	if err := ws.Send(p); err == nil {
+		t.Errorf("Send to evicted websocket should fail")
+	}
+}
+
+// Connect n webSockets to clients which drain and count received messages.
+// The webSockets are upgraded with Thing's upgrader, and plugged into Thing's
+// bus, ready for broadcasts.  Clients offer compression, as browsers do.
+func benchSockets(b *testing.B, thing *Thing, n int) ([]*webSocket, chan bool, func()) {
+	var socks []*webSocket
+	var clients []*websocket.Conn
+
+	got := make(chan bool, n)
+	conns := make(chan *websocket.Conn, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, _ := thing.web.upgrader.Upgrade(w, r, nil)
+			conns <- conn
+		}))
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	dialer := websocket.Dialer{EnableCompression: true}
+
+	for i := 0; i < n; i++ {
+		client, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			b.Fatalf("Dial %s failed: %s", url, err)
+		}
+		clients = append(clients, client)
+		sock := newWebSocket(thing, "bench", <-conns)
+		sock.SetFlags(sock_flag_bcast)
+		thing.bus.plugin(sock)
+		socks = append(socks, sock)
+		go func() {
+			for {
+				if _, _, err := client.ReadMessage(); err != nil {
+					return
+				}
+				got <- true
+			}
+		}()
+	}
+
+	return socks, got, func() {
+		for i := range socks {
+			thing.bus.unplug(socks[i])
+			socks[i].Close()
+			clients[i].Close()
+		}
+		server.Close()
+	}
+}
+
+// Broadcast a message to many websockets, as configured by default and with
+// compression.  With compression, the broadcast message is prepared (and
+// compressed) once; compare with sending the message unprepared to each
+// websocket.
+func BenchmarkBroadcast(b *testing.B) {
+	const sockets = 50
+
+	// A biggish state message
+	state := struct {
+		Msg  string
+		Data []int
+	}{Msg: ReplyState, Data: make([]int, 1000)}
+	for i := range state.Data {
+		state.Data[i] = i
+	}
+
+	benches := []struct {
+		name     string
+		compress bool
+		prepare  bool
+	}{
+		{"default", false, true},
+		{"compress", true, true},
+		{"compress/unprepared", true, false},
+	}
+
+	for _, bench := range benches {
+		b.Run(bench.name, func(b *testing.B) {
+			thing := NewThing(&empty{})
+			thing.Cfg.Id = testId
+			thing.Cfg.LoggingEnabled = false
+			thing.Cfg.WebSocketCompress = bench.compress
+			thing.Cfg.MaxConnections = sockets
+			if err := thing.build(false); err != nil {
+				b.Fatalf("Build failed: %s", err)
+			}
+
+			socks, got, done := benchSockets(b, thing, sockets)
+			defer done()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p := newPacket(thing.bus, nil, &state)
+				if bench.prepare {
+					thing.bus.broadcast(p)
+				} else {
+					for _, sock := range socks {
+						sock.Send(p)
+					}
+				}
+				for range socks {
+					<-got
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2021-2022 Scott Feldman (sfeldma@gmail.com). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package merle
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Websocket opcodes (RFC 6455)
+const (
+	wsOpContinuation byte = 0x0
+	wsOpText         byte = 0x1
+	wsOpBinary       byte = 0x2
+	wsOpClose        byte = 0x8
+	wsOpPing         byte = 0x9
+	wsOpPong         byte = 0xa
+)
+
+// Largest message a wsClient reads.  Microcontrollers don't have much RAM to
+// spare.
+const wsClientMaxMessage = 16 * 1024
+
+// Appended to the handshake key to compute the accept key
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// A wsClient is a minimal websocket client, small enough for TinyGo.  It
+// speaks just enough RFC 6455 to exchange messages with a Thing's websocket
+// server: no extensions, no compression.  It's safe to write on a wsClient
+// from any number of go funcs, but only one go func should read.
+type wsClient struct {
+	conn  io.ReadWriteCloser
+	r     *bufio.Reader
+	wlock sync.Mutex
+	// If not zero, readMessage() fails if no frame, not even a pong,
+	// arrives for this long.  Only for conns with read deadlines.
+	readTimeout time.Duration
+}
+
+// Conns with read deadlines, such as net.Conn
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Open a websocket on conn to path on host.  If token isn't "", token is
+// presented as a bearer token.
+func newWsClient(conn io.ReadWriteCloser, host, path, token string) (*wsClient, error) {
+	c := &wsClient{conn: conn, r: bufio.NewReader(conn)}
+	if err := c.handshake(host, path, token); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func wsAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (c *wsClient) handshake(host, path, token string) error {
+	var nonce [16]byte
+	for i := range nonce {
+		nonce[i] = byte(rand.Intn(256))
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n"
+	if token != "" {
+		req += "Authorization: Bearer " + token + "\r\n"
+	}
+	req += "\r\n"
+
+	if _, err := io.WriteString(c.conn, req); err != nil {
+		return err
+	}
+
+	status, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if fields := strings.Fields(status); len(fields) < 2 || fields[1] != "101" {
+		return fmt.Errorf("Websocket handshake failed: %s",
+			strings.TrimSpace(status))
+	}
+
+	accept := ""
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(line[:i]), "Sec-WebSocket-Accept") {
+			accept = strings.TrimSpace(line[i+1:])
+		}
+	}
+
+	if accept != wsAcceptKey(key) {
+		return fmt.Errorf("Websocket handshake failed: bad accept key")
+	}
+
+	return nil
+}
+
+func (c *wsClient) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var hdr [8]byte
+
+	if _, err = io.ReadFull(c.r, hdr[:2]); err != nil {
+		return
+	}
+
+	fin = hdr[0]&0x80 != 0
+	op = hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	n := uint64(hdr[1] & 0x7f)
+
+	switch n {
+	case 126:
+		if _, err = io.ReadFull(c.r, hdr[:2]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		if _, err = io.ReadFull(c.r, hdr[:8]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(hdr[:8])
+	}
+
+	if n > wsClientMaxMessage {
+		err = fmt.Errorf("Websocket frame too big: %d bytes", n)
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return
+}
+
+// Read the next message.  Pings are answered, pongs are ignored, and
+// fragmented messages are put back together.  Reading a close returns io.EOF.
+func (c *wsClient) readMessage() ([]byte, error) {
+	var msg []byte
+
+	for {
+		if d, ok := c.conn.(readDeadliner); ok && c.readTimeout > 0 {
+			d.SetReadDeadline(time.Now().Add(c.readTimeout))
+		}
+
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// Echo the close status back
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		}
+
+		msg = append(msg, payload...)
+		if len(msg) > wsClientMaxMessage {
+			return nil, fmt.Errorf("Websocket message too big: %d bytes",
+				len(msg))
+		}
+
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// Client frames are always masked
+func (c *wsClient) writeFrame(op byte, payload []byte) error {
+	n := len(payload)
+	frame := make([]byte, 0, 14+n)
+
+	frame = append(frame, 0x80|op)
+
+	switch {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		frame = append(frame, 0x80|127)
+		frame = append(frame, ext[:]...)
+	}
+
+	var mask [4]byte
+	binary.BigEndian.PutUint32(mask[:], rand.Uint32())
+	frame = append(frame, mask[:]...)
+
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Ping the server; the server's pong is read by readMessage()
+func (c *wsClient) ping() error {
+	return c.writeFrame(wsOpPing, nil)
+}
+
+// Write a text message
+func (c *wsClient) writeMessage(msg []byte) error {
+	return c.writeFrame(wsOpText, msg)
+}
+
+// Close the websocket's connection.  A reader blocked in readMessage()
+// returns an error.
+func (c *wsClient) close() error {
+	return c.conn.Close()
+}